@@ -0,0 +1,259 @@
+// Command nacre-tail prints the output of a nacre feed to the terminal as it arrives.
+//
+// Usage:
+//
+//	nacre-tail [flags] <feed URL or ID>
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/johanmickos/nacre/internal/ws"
+)
+
+const (
+	reconnectMinDelay = time.Second * 1
+	reconnectMaxDelay = time.Second * 30
+
+	// passwordHeader carries the password of password-protected feeds, which is
+	// exchanged for the feed's view key sent in viewKeyHeader.
+	passwordHeader = "X-Nacre-Password"
+	viewKeyHeader  = "X-Nacre-View-Key"
+)
+
+// errFeedEnded is returned when the feed's producer has disconnected.
+var errFeedEnded = errors.New("feed ended")
+
+// fatalError is a close reason which must not be retried.
+type fatalError struct{ msg string }
+
+func (e fatalError) Error() string { return e.msg }
+
+func main() {
+	server := flag.String("server", "https://nacre.dev", "Base URL of the nacre server, used when given a feed ID")
+	fromStart := flag.Bool("from-start", false, "Print the feed from its start")
+	tail := flag.Int("tail", 10, "Print the feed's last N lines before following it")
+	password := flag.String("password", "", "Password of a password-protected feed, defaults to $NACRE_PASSWORD")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <feed URL or ID>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *password == "" {
+		// Unlike flags, the environment keeps the password out of the process list
+		*password = os.Getenv("NACRE_PASSWORD")
+	}
+	if flag.NArg() != 1 || *tail < 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	endpoint, feedID, err := parseFeed(flag.Arg(0), *server)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "nacre-tail: %s\n", err)
+		os.Exit(2)
+	}
+	query := url.Values{}
+	if !*fromStart {
+		query.Set(ws.TailParam, strconv.Itoa(*tail))
+	}
+
+	header := http.Header{}
+	if *password != "" {
+		key, err := exchangePassword(endpoint, feedID, *password)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "nacre-tail: %s\n", err)
+			os.Exit(1)
+		}
+		header.Set(viewKeyHeader, key)
+	}
+
+	t := &tailer{endpoint: endpoint, feedID: feedID, header: header, out: os.Stdout}
+	if err := t.run(query); errors.Is(err, errFeedEnded) {
+		fmt.Fprintln(os.Stderr, "nacre-tail: feed ended")
+	} else {
+		fmt.Fprintf(os.Stderr, "nacre-tail: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// parseFeed returns the websocket endpoint and feed ID identified by the feed's
+// URL, such as https://nacre.dev/feed/${id}, or by its ID on the provided server.
+func parseFeed(feed string, server string) (string, string, error) {
+	base := server
+	id := feed
+	if strings.Contains(feed, "://") {
+		u, err := url.Parse(feed)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid feed URL: %w", err)
+		}
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) < 2 || parts[len(parts)-2] != "feed" {
+			return "", "", fmt.Errorf("invalid feed URL: expected %s://%s/feed/${id}", u.Scheme, u.Host)
+		}
+		id = parts[len(parts)-1]
+		base = (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid server URL: %w", err)
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	default:
+		return "", "", fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/websocket"
+	return u.String(), id, nil
+}
+
+// exchangePassword exchanges the feed's password for its view key through the API
+// of the server which hosts the websocket endpoint.
+func exchangePassword(endpoint string, feedID string, password string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+	u.Path = strings.TrimSuffix(u.Path, "/websocket") + "/api/v1/feeds/" + url.PathEscape(feedID) + "/access"
+	req, err := http.NewRequest(http.MethodPost, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(passwordHeader, password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", errors.New("feed not found, check the feed URL or ID")
+	case http.StatusUnauthorized:
+		return "", errors.New("incorrect password")
+	case http.StatusTooManyRequests:
+		return "", errors.New("too many incorrect passwords, try again later")
+	default:
+		return "", fmt.Errorf("exchanging password: unexpected status %s", resp.Status)
+	}
+	var access struct {
+		ViewKey string `json:"view_key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&access); err != nil {
+		return "", fmt.Errorf("exchanging password: %w", err)
+	}
+	return access.ViewKey, nil
+}
+
+// tailer follows a feed over its websocket endpoint, reconnecting and resuming
+// after the last received entry when the connection drops.
+type tailer struct {
+	endpoint string
+	feedID   string
+	header   http.Header // Sent with every websocket handshake
+	out      io.Writer
+
+	lastID string // ID of the last received entry, for resuming after reconnecting
+}
+
+func (t *tailer) run(query url.Values) error {
+	delay := reconnectMinDelay
+	for {
+		if t.lastID != "" {
+			query = url.Values{ws.ResumeParam: {t.lastID}}
+		}
+		received, err := t.follow(query)
+		var fatal fatalError
+		if errors.Is(err, errFeedEnded) || errors.As(err, &fatal) {
+			return err
+		}
+		if received {
+			delay = reconnectMinDelay
+		}
+		fmt.Fprintf(os.Stderr, "nacre-tail: connection lost (%s), retrying in %s\n", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
+
+// follow the feed until the connection closes, returning whether any entries were received.
+func (t *tailer) follow(query url.Values) (bool, error) {
+	endpoint := t.endpoint
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(endpoint, t.header)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(t.feedID)); err != nil {
+		return false, err
+	}
+
+	received := false
+	for {
+		msgType, msg, err := conn.ReadMessage()
+		if err != nil {
+			return received, closeError(err)
+		}
+		if msgType != websocket.BinaryMessage {
+			continue
+		}
+		id, data, err := ws.DecodeEntry(msg)
+		if err != nil {
+			return received, err
+		}
+		if id == "" {
+			// Notices from the server are not part of the feed's output
+			os.Stderr.Write(data)
+			continue
+		}
+		if _, err := t.out.Write(data); err != nil {
+			return received, fatalError{msg: err.Error()}
+		}
+		t.lastID = id
+		received = true
+	}
+}
+
+// closeError translates the websocket's close reason into a friendly error.
+func closeError(err error) error {
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		return err
+	}
+	switch closeErr.Code {
+	case websocket.CloseNormalClosure:
+		return errFeedEnded
+	case ws.CloseNotFound:
+		return fatalError{msg: "feed not found, check the feed URL or ID"}
+	case ws.CloseUnauthorized:
+		return fatalError{msg: "feed is password protected, set its current password with -password"}
+	case ws.CloseTooManyPeers:
+		return fatalError{msg: "too many viewers are watching this feed, try again later"}
+	case websocket.CloseUnsupportedData:
+		return fatalError{msg: fmt.Sprintf("server rejected the request: %s", closeErr.Text)}
+	case websocket.CloseGoingAway:
+		return errors.New("server went away")
+	}
+	return err
+}
@@ -0,0 +1,373 @@
+// Command nacre streams its standard input, or the output of a wrapped command,
+// to a nacre server while also writing it to the terminal.
+//
+// Usage:
+//
+//	make test | nacre [flags]
+//	nacre [flags] -- make test
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	dialTimeout       = time.Second * 10
+	reconnectMinDelay = time.Second * 1
+	reconnectMaxDelay = time.Second * 30
+	maxReconnects     = 10
+	// stableConnectionPeriod is how long a connection must stay open before its failure
+	// resets the reconnection attempts. Connections which the server closes sooner, e.g.
+	// once the daily quota is exhausted, count as failed attempts.
+	stableConnectionPeriod = time.Second * 30
+
+	// maxBufferedBytes bounds the output buffered while disconnected from the server.
+	// The oldest output is dropped beyond it.
+	maxBufferedBytes = 1024 * 1024
+
+	greetingServingAt  = "Serving at: "
+	greetingOwnerToken = "Owner token: "
+	serverNoticePrefix = "nacre: "
+)
+
+func main() {
+	server := flag.String("server", "nacre.dev:1337", "Address of the nacre server")
+	useTLS := flag.Bool("tls", false, "Connect to the server's TLS listener")
+	name := flag.String("name", "", "Request a custom feed name")
+	password := flag.String("password", "", "Require viewers to enter this password, defaults to $NACRE_PASSWORD")
+	delay := flag.Duration("delay", 0, "Wait this long after printing the feed URL before uploading output")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags] [-- command [args...]]\n", os.Args[0])
+		fmt.Fprintln(out, "Streams standard input, or the output of the command, to nacre.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *password == "" {
+		// Unlike flags, the environment keeps the password out of the process list
+		*password = os.Getenv("NACRE_PASSWORD")
+	}
+	if strings.ContainsAny(*password, " \t\r\n") {
+		fmt.Fprintln(os.Stderr, "nacre: passwords must not contain whitespace")
+		os.Exit(2)
+	}
+
+	buf := newUploadBuffer(maxBufferedBytes)
+	up := &uploader{
+		address:  *server,
+		useTLS:   *useTLS,
+		name:     *name,
+		password: *password,
+		delay:    *delay,
+		buf:      buf,
+	}
+	feedURL, err := up.connect()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "nacre: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "nacre: serving at %s\n", feedURL)
+
+	uploaded := make(chan error, 1)
+	go func() { uploaded <- up.run() }()
+
+	exitCode := 0
+	if flag.NArg() > 0 {
+		exitCode = runCommand(flag.Args(), buf)
+	} else if _, err := io.Copy(io.MultiWriter(os.Stdout, buf), os.Stdin); err != nil {
+		fmt.Fprintf(os.Stderr, "nacre: reading standard input: %s\n", err)
+		exitCode = 1
+	}
+	buf.Close()
+
+	if err := <-uploaded; err != nil {
+		fmt.Fprintf(os.Stderr, "nacre: %s\n", err)
+		if exitCode == 0 {
+			exitCode = 1
+		}
+	}
+	os.Exit(exitCode)
+}
+
+// runCommand runs the command with its output teed to the buffer, reports its exit
+// status to the feed, and returns its exit code.
+func runCommand(args []string, buf *uploadBuffer) int {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = io.MultiWriter(os.Stdout, buf)
+	cmd.Stderr = io.MultiWriter(os.Stderr, buf)
+
+	// Interrupts are delivered to the command, which is in the same process group.
+	// Outlive it so that its remaining output and exit status are uploaded.
+	signal.Ignore(syscall.SIGINT)
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		fmt.Fprintf(buf, "\n[nacre: %s exited with status 0]\n", args[0])
+		return 0
+	case errors.As(err, &exitErr):
+		status := exitErr.ExitCode()
+		if wait, ok := exitErr.Sys().(syscall.WaitStatus); ok && wait.Signaled() {
+			fmt.Fprintf(buf, "\n[nacre: %s was terminated by %s]\n", args[0], wait.Signal())
+			return 128 + int(wait.Signal())
+		}
+		fmt.Fprintf(buf, "\n[nacre: %s exited with status %d]\n", args[0], status)
+		return status
+	default:
+		fmt.Fprintf(os.Stderr, "nacre: %s\n", err)
+		fmt.Fprintf(buf, "\n[nacre: failed to run %s: %s]\n", args[0], err)
+		return 127
+	}
+}
+
+// uploader streams buffered output to the server, reattaching to the feed with
+// its owner token when the connection drops.
+type uploader struct {
+	address  string
+	useTLS   bool
+	name     string
+	password string // Only sent when creating the feed, which keeps it on reattaching
+	delay    time.Duration
+	buf      *uploadBuffer
+
+	conn        net.Conn
+	connectedAt time.Time
+	attempts    int    // Reconnection attempts since the last stable connection
+	feed        string // ID of the feed, once created
+	token       string // Owner token of the feed, once created
+	closed      chan struct{}
+}
+
+// connect to the server and create or reattach to the feed, returning the feed's URL.
+func (u *uploader) connect() (string, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if u.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", u.address, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", u.address)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Always send a handshake so the server doesn't wait for one
+	var options []string
+	if u.feed != "" {
+		options = append(options, "feed="+u.feed, "token="+u.token)
+	} else {
+		if u.name != "" {
+			options = append(options, "name="+u.name)
+		}
+		if u.password != "" {
+			options = append(options, "password="+u.password)
+		}
+	}
+	handshake := fmt.Sprintf("NACRE %s\n", strings.Join(options, " "))
+	if _, err := io.WriteString(conn, handshake); err != nil {
+		conn.Close()
+		return "", err
+	}
+
+	reader := bufio.NewReader(conn)
+	feedURL, err := u.readGreeting(conn, reader)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	u.conn = conn
+	u.connectedAt = time.Now()
+	u.closed = make(chan struct{})
+	go u.readNotices(reader, u.closed)
+	return feedURL, nil
+}
+
+// readGreeting parses the feed's URL, ID and owner token from the server's greeting.
+func (u *uploader) readGreeting(conn net.Conn, reader *bufio.Reader) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("reading greeting: %w", err)
+	}
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, serverNoticePrefix) {
+		return "", errors.New(strings.TrimPrefix(line, serverNoticePrefix))
+	}
+	_, feedURL, ok := strings.Cut(line, greetingServingAt)
+	if !ok {
+		return "", fmt.Errorf("unexpected greeting %q", line)
+	}
+	if u.feed != "" {
+		return feedURL, nil
+	}
+
+	line, err = reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("reading greeting: %w", err)
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, greetingOwnerToken) {
+		return "", fmt.Errorf("unexpected greeting %q", line)
+	}
+	u.token, _, _ = strings.Cut(strings.TrimPrefix(line, greetingOwnerToken), " ")
+	u.feed = feedURL[strings.LastIndex(feedURL, "/")+1:]
+	return feedURL, nil
+}
+
+// readNotices prints the server's notices, such as throttling warnings, until the
+// connection closes.
+func (u *uploader) readNotices(reader *bufio.Reader, closed chan struct{}) {
+	defer close(closed)
+	for {
+		line, err := reader.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			fmt.Fprintln(os.Stderr, line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// run uploads the buffered output until the buffer is closed and drained.
+func (u *uploader) run() error {
+	defer func() {
+		if u.conn != nil {
+			u.conn.Close()
+		}
+	}()
+	time.Sleep(u.delay)
+	for {
+		data, ok := u.buf.Next()
+		if !ok {
+			return nil
+		}
+		n, err := 0, errors.New("closed by server")
+		select {
+		case <-u.closed:
+		default:
+			n, err = u.conn.Write(data)
+		}
+		if err != nil {
+			// Only the unwritten remainder is resent, as the server already received the rest
+			u.buf.Unread(data[n:])
+			if err := u.reconnect(err); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reconnect to the feed after the connection failed with the provided error.
+func (u *uploader) reconnect(cause error) error {
+	u.conn.Close()
+	<-u.closed
+	if time.Since(u.connectedAt) >= stableConnectionPeriod {
+		u.attempts = 0
+	}
+	for u.attempts < maxReconnects {
+		u.attempts++
+		delay := reconnectMinDelay << (u.attempts - 1)
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+		fmt.Fprintf(os.Stderr, "nacre: connection lost (%s), reconnecting in %s\n", cause, delay)
+		time.Sleep(delay)
+		_, err := u.connect()
+		if err == nil {
+			fmt.Fprintln(os.Stderr, "nacre: reconnected")
+			return nil
+		}
+		cause = err
+	}
+	return fmt.Errorf("giving up after %d reconnection attempts: %w", maxReconnects, cause)
+}
+
+// uploadBuffer holds output until it is uploaded, dropping the oldest output
+// once it exceeds its capacity.
+type uploadBuffer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	data     []byte
+	capacity int
+	dropped  int
+	closed   bool
+}
+
+func newUploadBuffer(capacity int) *uploadBuffer {
+	b := &uploadBuffer{capacity: capacity}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Write appends the data to the buffer. It never fails, so that the output
+// written to the terminal is never held up by the upload.
+func (b *uploadBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data = append(b.data, p...)
+	if excess := len(b.data) - b.capacity; excess > 0 {
+		b.data = append([]byte(nil), b.data[excess:]...)
+		b.dropped += excess
+	}
+	b.cond.Signal()
+	return len(p), nil
+}
+
+// Close marks the end of the output.
+func (b *uploadBuffer) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.cond.Signal()
+}
+
+// Next blocks until output is available and removes it from the buffer.
+// Returns false once the buffer is closed and drained.
+func (b *uploadBuffer) Next() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.data) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if len(b.data) == 0 {
+		return nil, false
+	}
+	data := b.data
+	b.data = nil
+	if b.dropped > 0 {
+		notice := fmt.Sprintf("\n[nacre: %d bytes of output were dropped while disconnected]\n", b.dropped)
+		data = append([]byte(notice), data...)
+		b.dropped = 0
+	}
+	return data, true
+}
+
+// Unread returns output which failed to upload to the front of the buffer.
+func (b *uploadBuffer) Unread(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data = append(append([]byte(nil), p...), b.data...)
+	if excess := len(b.data) - b.capacity; excess > 0 {
+		b.data = b.data[excess:]
+		b.dropped += excess
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"log"
+	"os/signal"
+	"syscall"
 
 	nacre "github.com/johanmickos/nacre/internal"
 	"golang.org/x/sync/errgroup"
@@ -15,24 +17,61 @@ func main() {
 	}
 	log.Print("Configuration: ", cfg)
 
-	rootCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	group, rootCtx := errgroup.WithContext(rootCtx)
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	// Serving continues after a signal is received, so that in-flight connections
+	// can be drained and feeds can be marked as disconnected in the hub.
+	group, rootCtx := errgroup.WithContext(context.Background())
 
 	nacreServer, err := nacre.DefaultServer(cfg)
 	if err != nil {
 		log.Fatalf("Failed to initialize nacre server: %v", err)
 	}
 
-	// TODO Propagate signal, gracefully shut down server
+	if nacreServer.TCP != nil {
+		group.Go(func() error {
+			nacreServer.TCP.Serve(rootCtx)
+			return nil
+		})
+	}
+	if nacreServer.TLS != nil {
+		group.Go(func() error {
+			nacreServer.TLS.Serve(rootCtx)
+			return nil
+		})
+	}
+	if nacreServer.SSH != nil {
+		group.Go(func() error {
+			nacreServer.SSH.Serve(rootCtx)
+			return nil
+		})
+	}
 	group.Go(func() error {
-		nacreServer.TCP.Serve(rootCtx)
-		return nil
+		return nacreServer.HTTP.Serve(rootCtx)
 	})
+	if nacreServer.Admin != nil {
+		group.Go(func() error {
+			return nacreServer.Admin.Serve(rootCtx)
+		})
+	}
 	group.Go(func() error {
-		return nacreServer.HTTP.Serve(rootCtx)
+		select {
+		case <-signalCtx.Done():
+			log.Print("Shutting down")
+		case <-rootCtx.Done():
+			log.Print("Shutting down after server failure")
+		}
+		stop() // A second signal terminates the process immediately
+		timeout := cfg.App.ShutdownTimeout
+		if nacreServer.Admin != nil {
+			timeout += cfg.App.DrainGracePeriod
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return nacreServer.Shutdown(shutdownCtx)
 	})
 	if err := group.Wait(); err != nil {
-		panic(err)
+		log.Fatalf("Server stopped: %v", err)
 	}
+	log.Print("Server stopped")
 }
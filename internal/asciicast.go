@@ -0,0 +1,87 @@
+package nacre
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"unicode/utf8"
+)
+
+// Default terminal dimensions of exported recordings.
+const (
+	asciicastDefaultWidth  = 80
+	asciicastDefaultHeight = 24
+)
+
+// asciicastHeader is the first line of an asciicast v2 recording.
+// See https://docs.asciinema.org/manual/asciicast/v2/ for the format specification.
+type asciicastHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Title     string `json:"title,omitempty"`
+}
+
+// writeAsciicast renders the feed entries as an asciicast v2 recording, where each entry
+// becomes an output event timed relative to the arrival of the first entry.
+func writeAsciicast(w io.Writer, id string, entries []Entry, width int, height int) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	header := asciicastHeader{
+		Version: 2,
+		Width:   width,
+		Height:  height,
+		Title:   id,
+	}
+	if len(entries) > 0 && !entries[0].Time.IsZero() {
+		header.Timestamp = entries[0].Time.Unix()
+	}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+
+	if isTruncated(entries) {
+		if err := enc.Encode([]any{0.0, "o", truncationNotice}); err != nil {
+			return err
+		}
+	}
+	var pending []byte
+	elapsed := 0.0
+	for _, entry := range entries {
+		if !entry.Time.IsZero() && !entries[0].Time.IsZero() {
+			elapsed = entry.Time.Sub(entries[0].Time).Seconds()
+		}
+		// Event data must be valid UTF-8, so hold back multi-byte
+		// characters which are split across entries.
+		var data []byte
+		data, pending = splitIncompleteRune(append(pending, entry.Data...))
+		if len(data) == 0 {
+			continue
+		}
+		if err := enc.Encode([]any{elapsed, "o", string(data)}); err != nil {
+			return err
+		}
+	}
+	if len(pending) > 0 {
+		if err := enc.Encode([]any{elapsed, "o", string(pending)}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// splitIncompleteRune splits b into its complete UTF-8 prefix and any trailing bytes of
+// an incomplete multi-byte character.
+func splitIncompleteRune(b []byte) ([]byte, []byte) {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		if !utf8.RuneStart(b[len(b)-i]) {
+			continue
+		}
+		if !utf8.FullRune(b[len(b)-i:]) {
+			return b[:len(b)-i], b[len(b)-i:]
+		}
+		break
+	}
+	return b, nil
+}
@@ -0,0 +1,33 @@
+package nacre
+
+import "testing"
+
+func TestSplitIncompleteRune(t *testing.T) {
+	euro := "€"           // 3 bytes
+	emoji := "\U0001F600" // 4 bytes
+	tests := []struct {
+		name         string
+		input        string
+		wantComplete string
+		wantRest     string
+	}{
+		{name: "empty", input: "", wantComplete: "", wantRest: ""},
+		{name: "ASCII", input: "abc", wantComplete: "abc", wantRest: ""},
+		{name: "complete multi-byte", input: "a" + euro, wantComplete: "a" + euro, wantRest: ""},
+		{name: "complete 4-byte", input: emoji, wantComplete: emoji, wantRest: ""},
+		{name: "first byte of 3", input: "a" + euro[:1], wantComplete: "a", wantRest: euro[:1]},
+		{name: "two bytes of 3", input: "a" + euro[:2], wantComplete: "a", wantRest: euro[:2]},
+		{name: "three bytes of 4", input: "ab" + emoji[:3], wantComplete: "ab", wantRest: emoji[:3]},
+		{name: "only incomplete", input: emoji[:2], wantComplete: "", wantRest: emoji[:2]},
+		{name: "stray continuation byte", input: "a" + euro[1:], wantComplete: "a" + euro[1:], wantRest: ""},
+		{name: "invalid start byte", input: "a\xff", wantComplete: "a\xff", wantRest: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			complete, rest := splitIncompleteRune([]byte(tt.input))
+			if string(complete) != tt.wantComplete || string(rest) != tt.wantRest {
+				t.Errorf("splitIncompleteRune(%q) = %q, %q, want %q, %q", tt.input, complete, rest, tt.wantComplete, tt.wantRest)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package nacre
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errDailyQuotaExceeded = errors.New("daily quota exceeded")
+
+// BandwidthLimiter defines functions for limiting the rate and volume of data
+// ingested from each client IP.
+type BandwidthLimiter interface {
+	// Stop the bandwidth limiter.
+	Stop()
+	// Reserve n bytes of the IP's bandwidth, returning how long the caller must wait
+	// before ingesting them. Returns errDailyQuotaExceeded if the IP has exhausted
+	// its quota for the current (UTC) day, in which case nothing is reserved.
+	Reserve(ip string, n int) (time.Duration, error)
+}
+
+// ipBandwidth is the bandwidth state of a single client IP.
+type ipBandwidth struct {
+	tokens    float64   // Available bytes in the token bucket, negative if in debt
+	updatedAt time.Time // Time at which 'tokens' was last refilled
+	day       time.Time // Start of the (UTC) day that 'used' is counted for
+	used      int64     // Bytes ingested during 'day'
+}
+
+// inMemoryBandwidthLimiter is a token bucket-based BandwidthLimiter implementation.
+//
+// Each IP's bucket holds up to 'burst' bytes and is refilled at 'bytesPerSecond'.
+// Reservations exceeding the available bytes put the bucket in debt, and the caller
+// is asked to wait until the debt is paid off, which throttles the client rather
+// than disconnecting it. Daily quotas are enforced on top of the throttling.
+//
+// Like inMemoryRateLimiter, this implementation does _not_ manage distributed state.
+type inMemoryBandwidthLimiter struct {
+	mu  sync.Mutex
+	ips map[string]*ipBandwidth
+
+	bytesPerSecond float64 // Refill rate of the token buckets, or 0 for no throttling
+	burst          float64 // Capacity of the token buckets
+	dailyQuota     int64   // Maximum # of bytes per IP per day, or 0 for no quota
+
+	gcPeriod time.Duration
+	quit     chan empty
+}
+
+var _ BandwidthLimiter = (*inMemoryBandwidthLimiter)(nil)
+
+// NewInMemoryBandwidthLimiter returns a memory-backed bandwidth limiter. A zero rate disables
+// throttling and a zero quota disables daily quotas. It also spins off a new background
+// goroutine for garbage collection, which can be stopped with inMemoryBandwidthLimiter.Stop().
+func NewInMemoryBandwidthLimiter(bytesPerSecond int, burst int, dailyQuota int64) BandwidthLimiter {
+	b := &inMemoryBandwidthLimiter{
+		mu:             sync.Mutex{},
+		ips:            make(map[string]*ipBandwidth),
+		bytesPerSecond: float64(bytesPerSecond),
+		burst:          float64(burst),
+		dailyQuota:     dailyQuota,
+		gcPeriod:       time.Minute * 1,
+		quit:           make(chan empty),
+	}
+	go b.garbageCollectLoop(context.Background())
+	return b
+}
+
+// Stop the background garbage collection goroutine.
+func (b *inMemoryBandwidthLimiter) Stop() { close(b.quit) }
+
+func (b *inMemoryBandwidthLimiter) Reserve(ip string, n int) (time.Duration, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	state, ok := b.ips[ip]
+	if !ok {
+		state = &ipBandwidth{tokens: b.burst, updatedAt: now}
+		b.ips[ip] = state
+	}
+	if today := startOfDay(now); !state.day.Equal(today) {
+		state.day, state.used = today, 0
+	}
+	if b.dailyQuota > 0 && state.used+int64(n) > b.dailyQuota {
+		return 0, errDailyQuotaExceeded
+	}
+	state.used += int64(n)
+	if b.bytesPerSecond <= 0 {
+		return 0, nil
+	}
+
+	b.refill(state, now)
+	state.tokens -= float64(n)
+	if state.tokens >= 0 {
+		return 0, nil
+	}
+	return time.Duration(-state.tokens / b.bytesPerSecond * float64(time.Second)), nil
+}
+
+func (b *inMemoryBandwidthLimiter) refill(state *ipBandwidth, now time.Time) {
+	state.tokens += now.Sub(state.updatedAt).Seconds() * b.bytesPerSecond
+	if state.tokens > b.burst {
+		state.tokens = b.burst
+	}
+	state.updatedAt = now
+}
+
+func (b *inMemoryBandwidthLimiter) garbageCollectLoop(ctx context.Context) {
+	ticker := time.NewTicker(b.gcPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.quit:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.garbageCollect()
+		}
+	}
+}
+
+// garbageCollect forgets IPs whose state is indistinguishable from that of a new IP,
+// i.e. whose bucket is full and who have not ingested anything today.
+func (b *inMemoryBandwidthLimiter) garbageCollect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	today := startOfDay(now)
+	for ip, state := range b.ips {
+		if b.bytesPerSecond > 0 {
+			b.refill(state, now)
+		}
+		full := b.bytesPerSecond <= 0 || state.tokens >= b.burst
+		if full && (state.used == 0 || !state.day.Equal(today)) {
+			delete(b.ips, ip)
+		}
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Hour * 24)
+}
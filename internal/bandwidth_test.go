@@ -0,0 +1,93 @@
+package nacre
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInMemoryBandwidthLimiterReserve(t *testing.T) {
+	type reservation struct {
+		ip       string
+		n        int
+		wantWait time.Duration
+		wantErr  error
+	}
+	tests := []struct {
+		name           string
+		bytesPerSecond int
+		burst          int
+		dailyQuota     int64
+		reservations   []reservation
+	}{
+		{
+			name:           "within burst",
+			bytesPerSecond: 1000, burst: 4000,
+			reservations: []reservation{
+				{ip: "192.0.2.1", n: 1000},
+				{ip: "192.0.2.1", n: 3000},
+			},
+		},
+		{
+			name:           "debt is paid off at the refill rate",
+			bytesPerSecond: 1000, burst: 4000,
+			reservations: []reservation{
+				{ip: "192.0.2.1", n: 4000},
+				{ip: "192.0.2.1", n: 500, wantWait: time.Millisecond * 500},
+				{ip: "192.0.2.1", n: 2000, wantWait: time.Millisecond * 2500},
+			},
+		},
+		{
+			name:           "buckets are per IP",
+			bytesPerSecond: 1000, burst: 4000,
+			reservations: []reservation{
+				{ip: "192.0.2.1", n: 6000, wantWait: time.Second * 2},
+				{ip: "192.0.2.2", n: 4000},
+			},
+		},
+		{
+			name:           "no throttling",
+			bytesPerSecond: 0, burst: 1,
+			reservations: []reservation{
+				{ip: "192.0.2.1", n: 1 << 20},
+				{ip: "192.0.2.1", n: 1 << 20},
+			},
+		},
+		{
+			name:           "daily quota",
+			bytesPerSecond: 0, burst: 1, dailyQuota: 5000,
+			reservations: []reservation{
+				{ip: "192.0.2.1", n: 4000},
+				{ip: "192.0.2.1", n: 2000, wantErr: errDailyQuotaExceeded},
+				{ip: "192.0.2.1", n: 1000},
+				{ip: "192.0.2.1", n: 1, wantErr: errDailyQuotaExceeded},
+				{ip: "192.0.2.2", n: 5000},
+			},
+		},
+		{
+			name:           "rejected reservations are not throttled",
+			bytesPerSecond: 1000, burst: 4000, dailyQuota: 5000,
+			reservations: []reservation{
+				{ip: "192.0.2.1", n: 4000},
+				{ip: "192.0.2.1", n: 2000, wantErr: errDailyQuotaExceeded},
+				{ip: "192.0.2.1", n: 1000, wantWait: time.Second},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewInMemoryBandwidthLimiter(tt.bytesPerSecond, tt.burst, tt.dailyQuota)
+			defer limiter.Stop()
+			for i, res := range tt.reservations {
+				wait, err := limiter.Reserve(res.ip, res.n)
+				if !errors.Is(err, res.wantErr) {
+					t.Fatalf("reservation %d: got error %v, want %v", i, err, res.wantErr)
+				}
+				// The buckets refill while the test runs, so waits may be slightly shorter
+				if wait > res.wantWait || wait < res.wantWait-time.Millisecond*100 {
+					t.Errorf("reservation %d: got wait %s, want %s", i, wait, res.wantWait)
+				}
+			}
+		})
+	}
+}
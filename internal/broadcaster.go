@@ -0,0 +1,228 @@
+package nacre
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const subscriptionBufferSize = 64
+
+// subscription is a single listener's view of a broadcasted feed.
+//
+// The subscription's channel is closed when the feed's client disconnects,
+// or when the listener falls too far behind the broadcast (in which case
+// 'lagged' is set before closing the channel).
+type subscription struct {
+	ch      chan redis.XMessage
+	startID string // ID of the last entry broadcasted before subscribing
+	lagged  bool
+}
+
+// broadcastFeed is the state of a single feed's broadcast loop.
+type broadcastFeed struct {
+	lastID      string
+	subscribers map[*subscription]empty
+	cancel      context.CancelFunc
+}
+
+// redisBroadcaster fans out Redis stream entries to all local listeners.
+//
+// Rather than having every listener poll Redis on its own, the broadcaster
+// holds a single blocking XREAD loop per actively-listened feed and forwards
+// new entries to the feed's subscribers. The loop is torn down when the last
+// subscriber leaves or when the feed's client disconnects.
+type redisBroadcaster struct {
+	hub *redisHub
+
+	mu    sync.Mutex
+	feeds map[string]*broadcastFeed
+}
+
+func newRedisBroadcaster(hub *redisHub) *redisBroadcaster {
+	return &redisBroadcaster{
+		hub:   hub,
+		mu:    sync.Mutex{},
+		feeds: make(map[string]*broadcastFeed),
+	}
+}
+
+// subscribe to new entries of the identified feed, starting a new broadcast loop if needed.
+// Entries up to and including the returned subscription's startID are never broadcasted
+// to it and must be read from the stream directly.
+func (b *redisBroadcaster) subscribe(ctx context.Context, id string) (*subscription, error) {
+	// Empty until looked up, as the stream's last entry is only needed to start a new loop
+	startID := ""
+	for {
+		b.mu.Lock()
+		feed, ok := b.feeds[id]
+		if !ok && startID != "" {
+			feedCtx, cancel := context.WithCancel(context.Background())
+			feed = &broadcastFeed{
+				lastID:      startID,
+				subscribers: make(map[*subscription]empty),
+				cancel:      cancel,
+			}
+			b.feeds[id] = feed
+			go b.run(feedCtx, id, feed, startID)
+		}
+		if feed != nil {
+			sub := &subscription{
+				ch:      make(chan redis.XMessage, subscriptionBufferSize),
+				startID: feed.lastID,
+			}
+			feed.subscribers[sub] = empty{}
+			b.mu.Unlock()
+			return sub, nil
+		}
+		b.mu.Unlock()
+
+		// Determine the starting position of the broadcast before creating it. This is
+		// retried whenever the feed's loop ended in the meantime, as a loop starting from
+		// a stale position would re-broadcast entries the subscriber reads directly.
+		startID = "0-0"
+		messages, err := b.hub.client.XRevRangeN(ctx, streamName(id), "+", "-", 1).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 {
+			startID = messages[0].ID
+		}
+	}
+}
+
+// unsubscribe from the identified feed, tearing down its broadcast loop if this was
+// the last subscriber.
+func (b *redisBroadcaster) unsubscribe(id string, sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	feed, ok := b.feeds[id]
+	if !ok {
+		return
+	}
+	if _, ok := feed.subscribers[sub]; !ok {
+		return
+	}
+	delete(feed.subscribers, sub)
+	b.stopIfUnusedLocked(id, feed)
+}
+
+func (b *redisBroadcaster) stopIfUnusedLocked(id string, feed *broadcastFeed) {
+	if len(feed.subscribers) > 0 {
+		return
+	}
+	feed.cancel()
+	if b.feeds[id] == feed {
+		delete(b.feeds, id)
+	}
+}
+
+// run the broadcast loop of the identified feed until its client disconnects,
+// an error occurs, or the context is cancelled.
+func (b *redisBroadcaster) run(ctx context.Context, id string, feed *broadcastFeed, lastID string) {
+	defer b.end(id, feed)
+
+	stream := streamName(id)
+	for {
+		state, err := b.hub.ClientState(ctx, id)
+		if err != nil {
+			return
+		}
+		disconnected := state == ClientStateDisconnected
+		block := redisReadTimeout
+		if disconnected {
+			// Drain whatever was pushed before the client disconnected
+			block = -1
+		}
+		args := &redis.XReadArgs{
+			Streams: []string{stream, lastID},
+			Block:   block,
+		}
+		streamData, err := b.hub.client.XRead(ctx, args).Result()
+		if err != nil && err != redis.Nil {
+			return
+		}
+		if err == nil {
+			messages := streamData[0].Messages
+			lastID = messages[len(messages)-1].ID
+			b.broadcast(id, feed, messages)
+		}
+		if disconnected {
+			return
+		}
+	}
+}
+
+func (b *redisBroadcaster) broadcast(id string, feed *broadcastFeed, messages []redis.XMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	feed.lastID = messages[len(messages)-1].ID
+	for sub := range feed.subscribers {
+		for _, msg := range messages {
+			select {
+			case sub.ch <- msg: // OK
+				continue
+			default:
+			}
+			// Don't let a single slow subscriber hold up the entire feed.
+			// It will have to catch up by reading the stream directly.
+			sub.lagged = true
+			close(sub.ch)
+			delete(feed.subscribers, sub)
+			break
+		}
+	}
+	b.stopIfUnusedLocked(id, feed)
+}
+
+// end the broadcast of the identified feed and notify all remaining subscribers.
+func (b *redisBroadcaster) end(id string, feed *broadcastFeed) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	feed.cancel()
+	if b.feeds[id] == feed {
+		delete(b.feeds, id)
+	}
+	for sub := range feed.subscribers {
+		close(sub.ch)
+		delete(feed.subscribers, sub)
+	}
+}
+
+// compareStreamIDs compares two Redis stream entry IDs of the form "<ms>-<seq>",
+// returning -1, 0 or 1 if 'a' is less than, equal to, or greater than 'b'.
+func compareStreamIDs(a, b string) int {
+	aMs, aSeq, _ := parseStreamID(a)
+	bMs, bSeq, _ := parseStreamID(b)
+	switch {
+	case aMs < bMs:
+		return -1
+	case aMs > bMs:
+		return 1
+	case aSeq < bSeq:
+		return -1
+	case aSeq > bSeq:
+		return 1
+	}
+	return 0
+}
+
+// parseStreamID parses a Redis stream entry ID, where the sequence part is optional.
+func parseStreamID(id string) (uint64, uint64, bool) {
+	msPart, seqPart, hasSeq := strings.Cut(id, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if !hasSeq {
+		return ms, 0, true
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return ms, seq, true
+}
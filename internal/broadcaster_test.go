@@ -0,0 +1,243 @@
+package nacre
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// receiveMessages reads n messages from the subscription, failing the test if they don't
+// arrive in time.
+func receiveMessages(t *testing.T, sub *subscription, n int) []string {
+	t.Helper()
+	timeout := time.After(time.Second * 5)
+	data := make([]string, 0, n)
+	for len(data) < n {
+		select {
+		case msg, ok := <-sub.ch:
+			if !ok {
+				t.Fatalf("subscription closed after %d of %d messages", len(data), n)
+			}
+			data = append(data, msg.Values["data"].(string))
+		case <-timeout:
+			t.Fatalf("received %d of %d messages before timing out", len(data), n)
+		}
+	}
+	return data
+}
+
+// waitClosed waits for the subscription's channel to be closed, discarding any messages.
+// Broadcast loops only notice disconnected clients between their blocking reads.
+func waitClosed(t *testing.T, sub *subscription) {
+	t.Helper()
+	timeout := time.After(redisReadTimeout * 2)
+	for {
+		select {
+		case _, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("subscription was not closed")
+		}
+	}
+}
+
+// broadcasting returns true if a broadcast loop is registered for the feed.
+func broadcasting(b *redisBroadcaster, id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.feeds[id]
+	return ok
+}
+
+func TestBroadcasterFanOut(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name        string
+		before      []string // Pushed before subscribing
+		after       []string // Pushed after subscribing
+		subscribers int
+	}{
+		{name: "single subscriber", after: []string{"a", "b", "c"}, subscribers: 1},
+		{name: "many subscribers", after: []string{"a", "b", "c"}, subscribers: 3},
+		{name: "existing entries are not broadcasted", before: []string{"x", "y"}, after: []string{"a", "b"}, subscribers: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub, _ := newTestRedisHub(t, 1024*1024)
+			if err := hub.ClientConnected(ctx, "feed"); err != nil {
+				t.Fatal(err)
+			}
+			pushChunks(t, hub, "feed", tt.before...)
+			wantStartID := "0-0"
+			if len(tt.before) > 0 {
+				entries, err := hub.GetEntries(ctx, "feed")
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantStartID = entries[len(entries)-1].ID
+			}
+
+			subs := make([]*subscription, tt.subscribers)
+			for i := range subs {
+				sub, err := hub.broadcaster.subscribe(ctx, "feed")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer hub.broadcaster.unsubscribe("feed", sub)
+				if sub.startID != wantStartID {
+					t.Errorf("subscriber %d: startID = %s, want %s", i, sub.startID, wantStartID)
+				}
+				subs[i] = sub
+			}
+			pushChunks(t, hub, "feed", tt.after...)
+			for i, sub := range subs {
+				if got := receiveMessages(t, sub, len(tt.after)); !reflect.DeepEqual(got, tt.after) {
+					t.Errorf("subscriber %d received %q, want %q", i, got, tt.after)
+				}
+			}
+		})
+	}
+}
+
+func TestBroadcasterLaggingSubscriber(t *testing.T) {
+	ctx := context.Background()
+	hub, _ := newTestRedisHub(t, 1024*1024)
+	if err := hub.ClientConnected(ctx, "feed"); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := hub.broadcaster.subscribe(ctx, "feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.broadcaster.unsubscribe("feed", sub)
+
+	// Never reading from the subscription lets it fall behind
+	for i := 0; i < subscriptionBufferSize*2; i++ {
+		pushChunks(t, hub, "feed", fmt.Sprintf("%d\n", i))
+	}
+	waitClosed(t, sub)
+	if !sub.lagged {
+		t.Error("lagging subscription was closed without being marked as lagged")
+	}
+	if broadcasting(hub.broadcaster, "feed") {
+		t.Error("broadcast continued without subscribers")
+	}
+}
+
+func TestListenCatchesUpAfterLagging(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub, _ := newTestRedisHub(t, 1024*1024)
+	if err := hub.ClientConnected(ctx, "feed"); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := hub.Listen(ctx, "feed", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushChunks(t, hub, "feed", "first")
+	receiveEntries(t, ch, 1)
+
+	// Not reading from the listener meanwhile makes its subscription lag behind
+	want := make([]string, subscriptionBufferSize*3)
+	for i := range want {
+		want[i] = fmt.Sprintf("%d\n", i)
+		pushChunks(t, hub, "feed", want[i])
+	}
+	time.Sleep(time.Millisecond * 100)
+	var got []string
+	for _, entry := range receiveEntries(t, ch, len(want)) {
+		got = append(got, string(entry.Data))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listener received %q, want %q", got, want)
+	}
+}
+
+func TestBroadcasterUnsubscribe(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name             string
+		subscribers      int
+		unsubscribe      int
+		wantBroadcasting bool
+	}{
+		{name: "remaining subscribers", subscribers: 2, unsubscribe: 1, wantBroadcasting: true},
+		{name: "last subscriber", subscribers: 2, unsubscribe: 2, wantBroadcasting: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub, _ := newTestRedisHub(t, 1024*1024)
+			if err := hub.ClientConnected(ctx, "feed"); err != nil {
+				t.Fatal(err)
+			}
+			subs := make([]*subscription, tt.subscribers)
+			for i := range subs {
+				sub, err := hub.broadcaster.subscribe(ctx, "feed")
+				if err != nil {
+					t.Fatal(err)
+				}
+				subs[i] = sub
+			}
+			for _, sub := range subs[:tt.unsubscribe] {
+				hub.broadcaster.unsubscribe("feed", sub)
+			}
+			if got := broadcasting(hub.broadcaster, "feed"); got != tt.wantBroadcasting {
+				t.Errorf("broadcasting = %t, want %t", got, tt.wantBroadcasting)
+			}
+			for _, sub := range subs[tt.unsubscribe:] {
+				pushChunks(t, hub, "feed", "a")
+				receiveMessages(t, sub, 1)
+				hub.broadcaster.unsubscribe("feed", sub)
+			}
+			// A new subscriber starts a new broadcast after the last entry
+			sub, err := hub.broadcaster.subscribe(ctx, "feed")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer hub.broadcaster.unsubscribe("feed", sub)
+			entries, err := hub.GetEntries(ctx, "feed")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) > 0 && sub.startID != entries[len(entries)-1].ID {
+				t.Errorf("startID = %s, want %s", sub.startID, entries[len(entries)-1].ID)
+			}
+			pushChunks(t, hub, "feed", "b")
+			if got := receiveMessages(t, sub, 1); got[0] != "b" {
+				t.Errorf("new subscriber received %q, want \"b\"", got[0])
+			}
+		})
+	}
+}
+
+func TestBroadcasterClientDisconnected(t *testing.T) {
+	ctx := context.Background()
+	hub, _ := newTestRedisHub(t, 1024*1024)
+	if err := hub.ClientConnected(ctx, "feed"); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := hub.broadcaster.subscribe(ctx, "feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.broadcaster.unsubscribe("feed", sub)
+	pushChunks(t, hub, "feed", "last")
+	if err := hub.ClientDisconnected(ctx, "feed"); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveMessages(t, sub, 1); got[0] != "last" {
+		t.Errorf("received %q, want \"last\"", got[0])
+	}
+	waitClosed(t, sub)
+	if sub.lagged {
+		t.Error("subscription of a disconnected feed was marked as lagged")
+	}
+	if broadcasting(hub.broadcaster, "feed") {
+		t.Error("broadcast continued after the client disconnected")
+	}
+}
@@ -0,0 +1,120 @@
+package nacre
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type contextKey int
+
+const clientIPKey contextKey = iota
+
+// withClientIP determines the client's IP address and stores it in the request's context.
+//
+// Requests from trusted proxies are attributed to the address which the proxies forwarded
+// in the Forwarded header (RFC 7239), or in the X-Forwarded-For header if there's none.
+// Proxies append the address they received the request from, so the addresses are walked
+// from the last one until an address which is not a trusted proxy is found. Addresses
+// further to the left were supplied by the client and cannot be trusted.
+func withClientIP(trusted CIDRs, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		ip := net.ParseIP(host)
+		if ip != nil && trusted.Contains(ip) {
+			hops := forwardedHops(r.Header.Values("Forwarded"))
+			if hops == nil {
+				hops = splitHeaderList(r.Header.Values("X-Forwarded-For"))
+			}
+			ip = forwardedClientIP(ip, hops, trusted)
+		}
+		if ip != nil {
+			r = r.WithContext(context.WithValue(r.Context(), clientIPKey, ip.String()))
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// requestClientIP returns the IP address of the client which made the request,
+// as determined by withClientIP.
+func requestClientIP(r *http.Request) (string, error) {
+	if ip, ok := r.Context().Value(clientIPKey).(string); ok {
+		return ip, nil
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	return host, err
+}
+
+// logClientIP returns the request's client IP for logging.
+func logClientIP(r *http.Request) string {
+	ip, err := requestClientIP(r)
+	if err != nil {
+		return "unknown"
+	}
+	return ip
+}
+
+// forwardedClientIP returns the rightmost forwarded address which is not a trusted proxy,
+// starting from the address of the proxy which sent the request.
+func forwardedClientIP(remote net.IP, hops []string, trusted CIDRs) net.IP {
+	client := remote
+	for i := len(hops) - 1; i >= 0 && trusted.Contains(client); i-- {
+		ip := parseForwardedNode(hops[i])
+		if ip == nil {
+			// Obfuscated or malformed addresses can't be attributed to anyone
+			// further, so the request is attributed to the proxy which sent it.
+			break
+		}
+		client = ip
+	}
+	return client
+}
+
+// forwardedHops returns the "for" parameters of the Forwarded headers' elements,
+// or nil if there are none.
+func forwardedHops(values []string) []string {
+	var hops []string
+	for _, element := range splitHeaderList(values) {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				hops = append(hops, value)
+			}
+		}
+	}
+	return hops
+}
+
+// splitHeaderList splits the comma-separated values of a header into their elements.
+func splitHeaderList(values []string) []string {
+	var elements []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				elements = append(elements, element)
+			}
+		}
+	}
+	return elements
+}
+
+// parseForwardedNode parses a forwarded node such as 192.0.2.43, "192.0.2.43:4711"
+// or "[2001:db8:cafe::17]:4711", returning nil for obfuscated or unknown nodes.
+func parseForwardedNode(node string) net.IP {
+	node = strings.Trim(node, `"`)
+	if strings.HasPrefix(node, "[") {
+		end := strings.Index(node, "]")
+		if end < 0 {
+			return nil
+		}
+		node = node[1:end]
+	} else if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	return net.ParseIP(node)
+}
@@ -0,0 +1,67 @@
+package nacre
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseForwardedNode(t *testing.T) {
+	tests := []struct {
+		node string
+		want string // Expected IP, or empty if the node can't be attributed
+	}{
+		{node: "192.0.2.43", want: "192.0.2.43"},
+		{node: `"192.0.2.43:4711"`, want: "192.0.2.43"},
+		{node: "2001:db8:cafe::17", want: "2001:db8:cafe::17"},
+		{node: `"[2001:db8:cafe::17]"`, want: "2001:db8:cafe::17"},
+		{node: `"[2001:db8:cafe::17]:4711"`, want: "2001:db8:cafe::17"},
+		{node: `"[2001:db8:cafe::17"`, want: ""},
+		{node: "unknown", want: ""},
+		{node: "_hidden", want: ""},
+		{node: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.node, func(t *testing.T) {
+			got := parseForwardedNode(tt.node)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("parseForwardedNode(%q) = %v, want nil", tt.node, got)
+				}
+				return
+			}
+			if !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("parseForwardedNode(%q) = %v, want %s", tt.node, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	trusted, err := ParseCIDRs("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		remote string
+		hops   []string
+		want   string
+	}{
+		{name: "untrusted remote", remote: "198.51.100.7", hops: []string{"203.0.113.9"}, want: "198.51.100.7"},
+		{name: "trusted remote without hops", remote: "10.0.0.1", hops: nil, want: "10.0.0.1"},
+		{name: "single proxy", remote: "10.0.0.1", hops: []string{"203.0.113.9"}, want: "203.0.113.9"},
+		{name: "chain of proxies", remote: "10.0.0.1", hops: []string{"203.0.113.9", "192.0.2.1", "10.0.0.2"}, want: "203.0.113.9"},
+		{name: "spoofed leftmost hop", remote: "10.0.0.1", hops: []string{"10.0.0.3", "203.0.113.9"}, want: "203.0.113.9"},
+		{name: "obfuscated hop", remote: "10.0.0.1", hops: []string{"203.0.113.9", "_hidden"}, want: "10.0.0.1"},
+		{name: "obfuscated hop after proxy", remote: "10.0.0.1", hops: []string{"unknown", "10.0.0.2"}, want: "10.0.0.2"},
+		{name: "all hops trusted", remote: "10.0.0.1", hops: []string{"10.0.0.3", "10.0.0.2"}, want: "10.0.0.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := forwardedClientIP(net.ParseIP(tt.remote), tt.hops, trusted)
+			if !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("forwardedClientIP(%s, %q) = %v, want %s", tt.remote, tt.hops, got, tt.want)
+			}
+		})
+	}
+}
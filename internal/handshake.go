@@ -0,0 +1,136 @@
+package nacre
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Clients may optionally start their data stream with a handshake line,
+// configuring the feed before any data is pushed to it:
+//
+//	NACRE name=nightly-build
+//
+// or reattaching to a feed they previously created using its owner token:
+//
+//	NACRE feed=nightly-build token=0wnerT0ken
+//
+// Either may set a password which viewers must enter before the feed is shown to them:
+//
+//	NACRE name=nightly-build password=hunter2
+//
+// Clients which don't send a handshake line are served as before.
+const (
+	handshakePrefix  = "NACRE "
+	handshakeTimeout = time.Millisecond * 500
+)
+
+// Handshake options.
+const (
+	handshakeOptionName     = "name"
+	handshakeOptionFeed     = "feed"
+	handshakeOptionToken    = "token"
+	handshakeOptionPassword = "password"
+)
+
+// maxFeedPasswordLength is the longest password bcrypt can hash.
+const maxFeedPasswordLength = 72
+
+var feedNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{2,63}$`)
+
+// handshake holds the options requested by a client.
+type handshake struct {
+	name  string // Requested feed name, if any
+	feed  string // Existing feed to reattach to, if any
+	token string // Owner token of the existing feed
+
+	password string // Password protecting the feed from viewers, if any
+
+	// Public key fingerprint of SSH clients, which owns their feeds instead of
+	// an owner token. Never set from the handshake line itself.
+	identity string
+}
+
+// readHandshake reads the client's handshake line, if it sent one. Data which does
+// not belong to a handshake is left unread in the reader.
+//
+// Plain clients like netcat never send a handshake, so readHandshake only waits
+// for a short while for the handshake prefix to arrive.
+func readHandshake(conn net.Conn, reader *bufio.Reader) (handshake, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	prefix, err := reader.Peek(len(handshakePrefix))
+	if err != nil || string(prefix) != handshakePrefix {
+		// No handshake. Any read error will resurface when reading the data stream.
+		return handshake{}, nil
+	}
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return handshake{}, errors.New("invalid handshake: line too long")
+		}
+		return handshake{}, fmt.Errorf("invalid handshake: %w", err)
+	}
+	return parseHandshake(string(line), "")
+}
+
+// parseHandshake parses a handshake line of space-separated key=value options,
+// sent by the client with the provided SSH key fingerprint, if any.
+func parseHandshake(line string, identity string) (handshake, error) {
+	hs := handshake{identity: identity}
+	fields := strings.Fields(strings.TrimPrefix(line, handshakePrefix))
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return hs, fmt.Errorf("invalid handshake option %q: expected key=value", field)
+		}
+		switch key {
+		case handshakeOptionName:
+			hs.name = value
+		case handshakeOptionFeed:
+			hs.feed = value
+		case handshakeOptionToken:
+			hs.token = value
+		case handshakeOptionPassword:
+			if value == "" {
+				return hs, errors.New("invalid handshake: 'password' must not be empty")
+			}
+			hs.password = value
+		default:
+			return hs, fmt.Errorf("unknown handshake option %q", key)
+		}
+	}
+	return hs, hs.validate()
+}
+
+// validate the combination of requested options.
+func (hs handshake) validate() error {
+	if hs.name != "" && !isValidFeedName(hs.name) {
+		return fmt.Errorf("invalid feed name %q: names must be 3-64 letters, digits, '-' or '_'", hs.name)
+	}
+	if len(hs.password) > maxFeedPasswordLength {
+		return fmt.Errorf("invalid password: passwords must be at most %d bytes", maxFeedPasswordLength)
+	}
+	if hs.name != "" && hs.feed != "" {
+		return errors.New("invalid handshake: 'name' and 'feed' are mutually exclusive")
+	}
+	if hs.identity != "" {
+		if hs.token != "" {
+			return errors.New("invalid handshake: feeds are owned by your SSH key, owner tokens are not used")
+		}
+		return nil
+	}
+	if (hs.feed == "") != (hs.token == "") {
+		return errors.New("invalid handshake: reattaching requires both 'feed' and 'token'")
+	}
+	return nil
+}
+
+func isValidFeedName(name string) bool {
+	return feedNamePattern.MatchString(name) && name != "example"
+}
@@ -0,0 +1,51 @@
+package nacre
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseHandshake(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		identity string
+		want     handshake
+		wantErr  bool
+	}{
+		{name: "empty", line: "NACRE \n", want: handshake{}},
+		{name: "feed name", line: "NACRE name=nightly-build\n", want: handshake{name: "nightly-build"}},
+		{name: "reattach", line: "NACRE feed=nightly-build token=0wnerT0ken\r\n", want: handshake{feed: "nightly-build", token: "0wnerT0ken"}},
+		{name: "password", line: "NACRE name=nightly-build password=hunter2\n", want: handshake{name: "nightly-build", password: "hunter2"}},
+		{name: "extra whitespace", line: "NACRE   name=nightly-build  \n", want: handshake{name: "nightly-build"}},
+		{name: "SSH reattach", line: "NACRE feed=nightly-build\n", identity: "SHA256:abc", want: handshake{feed: "nightly-build", identity: "SHA256:abc"}},
+		{name: "missing value", line: "NACRE name\n", wantErr: true},
+		{name: "unknown option", line: "NACRE color=red\n", wantErr: true},
+		{name: "empty password", line: "NACRE password=\n", wantErr: true},
+		{name: "password too long", line: "NACRE password=" + strings.Repeat("x", maxFeedPasswordLength+1) + "\n", wantErr: true},
+		{name: "name too short", line: "NACRE name=ab\n", wantErr: true},
+		{name: "name with invalid characters", line: "NACRE name=nightly.build\n", wantErr: true},
+		{name: "reserved name", line: "NACRE name=example\n", wantErr: true},
+		{name: "name and feed", line: "NACRE name=nightly-build feed=other-build token=0wnerT0ken\n", wantErr: true},
+		{name: "feed without token", line: "NACRE feed=nightly-build\n", wantErr: true},
+		{name: "token without feed", line: "NACRE token=0wnerT0ken\n", wantErr: true},
+		{name: "SSH token", line: "NACRE feed=nightly-build token=0wnerT0ken\n", identity: "SHA256:abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHandshake(tt.line, tt.identity)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseHandshake(%q) = %+v, want %+v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
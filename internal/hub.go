@@ -2,8 +2,10 @@ package nacre
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis/v9"
@@ -13,12 +15,37 @@ import (
 type Hub interface {
 	// FeedExists returns true if there is data for the identified feed.
 	FeedExists(ctx context.Context, id string) (bool, error)
+	// ReserveFeed claims the identified feed for a new client, returning false if the feed
+	// already exists or has been reserved by another client. Reservations last as long as
+	// the feed's data is persisted, and record the (hashed) identity of the feed's owner.
+	ReserveFeed(ctx context.Context, id string, owner string) (bool, error)
+	// FeedOwner returns the owner recorded when the identified feed was reserved,
+	// or an empty string if the feed has no known owner.
+	FeedOwner(ctx context.Context, id string) (string, error)
+	// SetFeedSecret records the hashed secret which viewers must present to read the
+	// identified feed, for as long as the feed's data is persisted. An empty secret
+	// makes the feed public again.
+	SetFeedSecret(ctx context.Context, id string, secret string) error
+	// FeedSecret returns the hashed secret protecting the identified feed,
+	// or an empty string if the feed is public.
+	FeedSecret(ctx context.Context, id string) (string, error)
 	// Push data to the identified feed.
 	Push(ctx context.Context, id string, data []byte) error
-	// Listen for data on the identified feed using the returned channel.
-	Listen(ctx context.Context, id string) (<-chan []byte, error)
+	// Listen for entries on the identified feed following the entry identified by lastID
+	// using the returned channel. An empty lastID listens from the start of the feed.
+	// If entries following lastID have been evicted, a Truncated entry is emitted in their place.
+	Listen(ctx context.Context, id string, lastID string) (<-chan Entry, error)
 	// GetAll data entries for the identified feed.
 	GetAll(ctx context.Context, id string) ([][]byte, error)
+	// GetEntries returns all entries, including their metadata, for the identified feed.
+	GetEntries(ctx context.Context, id string) ([]Entry, error)
+	// GetEntriesAfter returns up to 'limit' entries of the identified feed following the
+	// entry identified by afterID, or following the start of the feed if afterID is empty.
+	// Returns errInvalidEntryID if afterID is not a valid entry ID.
+	GetEntriesAfter(ctx context.Context, id string, afterID string, limit int) ([]Entry, error)
+	// FeedInfo returns metadata about the identified feed, which is zero-valued
+	// if the feed has no data.
+	FeedInfo(ctx context.Context, id string) (FeedInfo, error)
 
 	// ClientState returns the current state of the client driving data to the identified feed.
 	ClientState(ctx context.Context, id string) (ClientState, error)
@@ -26,14 +53,58 @@ type Hub interface {
 	ClientConnected(ctx context.Context, id string) error
 	// ClientConnected updates the current state of the client to 'DISCONNECTED' for the identified feed.
 	ClientDisconnected(ctx context.Context, id string) error
+
+	// Ping checks whether the hub's backend is reachable.
+	Ping(ctx context.Context) error
+	// Close releases the hub's resources. The hub must not be used afterwards.
+	Close() error
 }
 
 // TODO Support these in external configuration file with defaults
 const (
 	redisReadTimeout        = time.Second * 5
+	memoryPollPeriod        = time.Second * 5
 	clientConnectedDuration = time.Second * 15
 )
 
+// Entry is a single chunk of data pushed to a feed.
+type Entry struct {
+	// ID uniquely identifies the entry within its feed. IDs are opaque to callers,
+	// but can be passed to Hub.Listen to resume listening after the entry.
+	ID   string
+	Data []byte
+	// Time at which the entry was received.
+	Time time.Time
+	// Offset of the entry's first byte within the feed's data.
+	Offset int64
+	// Seq is the entry's 1-based sequence number within the feed.
+	Seq int64
+	// Truncated marks a placeholder entry without ID or data, which Hub.Listen emits in place
+	// of entries that were evicted from the feed before they could be delivered.
+	Truncated bool
+}
+
+// truncationNotice is shown to viewers in place of evicted feed data.
+const truncationNotice = "[nacre: earlier output was truncated]\r\n"
+
+// isTruncated returns true if entries at the start of the feed were evicted
+// before the provided entries, which must start at the oldest retained entry.
+func isTruncated(entries []Entry) bool {
+	return len(entries) > 0 && entries[0].Offset > 0
+}
+
+var errInvalidEntryID = errors.New("invalid entry ID")
+
+// FeedInfo is metadata about a feed and the data pushed to it.
+type FeedInfo struct {
+	Entries         int64 // Number of entries ever pushed to the feed
+	Bytes           int64 // Number of bytes ever pushed to the feed
+	RetainedEntries int64 // Number of entries which have not been evicted
+	RetainedBytes   int64 // Number of bytes which have not been evicted
+	Created         time.Time
+	Updated         time.Time
+}
+
 // ClientState indicates whether the data-streaming client is still connected.
 type ClientState string
 
@@ -45,21 +116,32 @@ const (
 )
 
 type redisHub struct {
-	client *redis.Client
+	client      *redis.Client
+	broadcaster *redisBroadcaster
 
-	maxRedisStreamLen            int
+	maxStreamBytes               int64
 	maxStreamPersistenceDuration time.Duration
 }
 
 var _ Hub = (*redisHub)(nil)
 
 // NewRedisHub allocates a new Redis-backed hub implementation.
-func NewRedisHub(client *redis.Client, maxRedisStreamLen int, maxStreamPersistenceDuration time.Duration) Hub {
-	return &redisHub{
+func NewRedisHub(client *redis.Client, maxStreamBytes int64, maxStreamPersistenceDuration time.Duration) Hub {
+	hub := &redisHub{
 		client:                       client,
-		maxRedisStreamLen:            maxRedisStreamLen,
+		maxStreamBytes:               maxStreamBytes,
 		maxStreamPersistenceDuration: maxStreamPersistenceDuration,
 	}
+	hub.broadcaster = newRedisBroadcaster(hub)
+	return hub
+}
+
+func (hub *redisHub) Ping(ctx context.Context) error {
+	return hub.client.Ping(ctx).Err()
+}
+
+func (hub *redisHub) Close() error {
+	return hub.client.Close()
 }
 
 func (hub *redisHub) FeedExists(ctx context.Context, id string) (bool, error) {
@@ -70,101 +152,231 @@ func (hub *redisHub) FeedExists(ctx context.Context, id string) (bool, error) {
 	return exists > 0, err
 }
 
-func (hub *redisHub) Push(ctx context.Context, id string, data []byte) error {
-	pipe := hub.client.Pipeline()
-	stream := streamName(id)
-	addCmd := pipe.XAdd(ctx, &redis.XAddArgs{
-		Stream: stream,
-		MaxLen: int64(hub.maxRedisStreamLen),
-		Approx: true,
-		// TODO Add relevant metadata to entries
-		Values: map[string]any{
-			"data": data,
-		},
-		ID: "*",
+// reserveScript atomically reserves a feed unless it already exists or is reserved.
+//
+// KEYS: stream, reservation
+// ARGV: persistence duration (ms), owner
+var reserveScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+if redis.call('SET', KEYS[2], ARGV[2], 'NX', 'PX', ARGV[1]) then
+	return 1
+end
+return 0
+`)
+
+func (hub *redisHub) ReserveFeed(ctx context.Context, id string, owner string) (bool, error) {
+	if id == "example" {
+		return false, nil
+	}
+	keys := []string{streamName(id), reservationKey(id)}
+	reserved, err := reserveScript.Run(ctx, hub.client, keys, hub.maxStreamPersistenceDuration.Milliseconds(), owner).Int()
+	return reserved == 1, err
+}
+
+func (hub *redisHub) FeedOwner(ctx context.Context, id string) (string, error) {
+	owner, err := hub.client.Get(ctx, reservationKey(id)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return owner, err
+}
+
+func (hub *redisHub) SetFeedSecret(ctx context.Context, id string, secret string) error {
+	// The secret is kept in the metadata hash, whose expiration is refreshed by every push
+	_, err := hub.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if secret == "" {
+			pipe.HDel(ctx, metadataKey(id), "secret")
+			return nil
+		}
+		pipe.HSet(ctx, metadataKey(id), "secret", secret)
+		pipe.PExpire(ctx, metadataKey(id), hub.maxStreamPersistenceDuration)
+		return nil
 	})
-	// Refresh expiration for this stream
-	// FIXME: Use ExpireGT if Redis v7 and higher
-	pipe.Expire(ctx, stream, hub.maxStreamPersistenceDuration)
-	if _, err := pipe.Exec(ctx); err != nil {
-		return err
+	return err
+}
+
+func (hub *redisHub) FeedSecret(ctx context.Context, id string) (string, error) {
+	secret, err := hub.client.HGet(ctx, metadataKey(id), "secret").Result()
+	if err == redis.Nil {
+		return "", nil
 	}
-	return addCmd.Err()
+	return secret, err
 }
 
-func (hub *redisHub) Listen(ctx context.Context, id string) (<-chan []byte, error) {
+// pushScript atomically appends an entry to a feed's stream along with its metadata,
+// which is derived from counters in the feed's metadata hash.
+//
+// Once the feed's stored data exceeds the maximum number of bytes, the oldest entries are
+// evicted until it fits again, though the newest entry is always kept. The ID of the newest
+// evicted entry is recorded as 'trimmed' in the metadata hash for detecting truncation.
+//
+// KEYS: stream, metadata hash, reservation
+// ARGV: data, receive time (unix ms), max stored bytes, persistence duration (ms)
+var pushScript = redis.NewScript(`
+local size = string.len(ARGV[1])
+local seq = redis.call('HINCRBY', KEYS[2], 'seq', 1)
+local offset = redis.call('HINCRBY', KEYS[2], 'bytes', size) - size
+redis.call('HSETNX', KEYS[2], 'created', ARGV[2])
+redis.call('HSET', KEYS[2], 'updated', ARGV[2])
+local id = redis.call('XADD', KEYS[1], '*',
+	'data', ARGV[1], 'ts', ARGV[2], 'offset', offset, 'seq', seq)
+local stored = redis.call('HINCRBY', KEYS[2], 'stored', size)
+while stored > tonumber(ARGV[3]) do
+	local oldest = redis.call('XRANGE', KEYS[1], '-', '+', 'COUNT', 1)[1]
+	if oldest == nil or oldest[1] == id then
+		break
+	end
+	local evicted = 0
+	for i = 1, #oldest[2], 2 do
+		if oldest[2][i] == 'data' then
+			evicted = string.len(oldest[2][i + 1])
+		end
+	end
+	redis.call('XDEL', KEYS[1], oldest[1])
+	redis.call('HSET', KEYS[2], 'trimmed', oldest[1])
+	stored = redis.call('HINCRBY', KEYS[2], 'stored', -evicted)
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+redis.call('PEXPIRE', KEYS[2], ARGV[4])
+redis.call('PEXPIRE', KEYS[3], ARGV[4])
+return id
+`)
+
+func (hub *redisHub) Push(ctx context.Context, id string, data []byte) error {
+	keys := []string{streamName(id), metadataKey(id), reservationKey(id)}
+	// Refreshes expiration for this stream
+	// FIXME: Use ExpireGT if Redis v7 and higher
+	return pushScript.Run(
+		ctx, hub.client, keys,
+		data,
+		time.Now().UnixMilli(),
+		hub.maxStreamBytes,
+		hub.maxStreamPersistenceDuration.Milliseconds(),
+	).Err()
+}
+
+func (hub *redisHub) Listen(ctx context.Context, id string, lastID string) (<-chan Entry, error) {
 	if id == "example" {
-		return hub.generateExampleData(ctx)
+		return generateExampleData(ctx, lastID)
 	}
 
-	ch := make(chan []byte)
+	ch := make(chan Entry)
 
 	go func() {
 		defer close(ch)
 
-		stream := streamName(id)
-		args := &redis.XReadArgs{
-			Streams: []string{stream, "0"},
-			Block:   -1,
-		}
-		streamData, err := hub.client.XRead(ctx, args).Result()
-		if err != nil {
-			return
+		lastSeenID := "0"
+		if _, _, ok := parseStreamID(lastID); ok {
+			lastSeenID = lastID
 		}
-		messages := streamData[0].Messages
-		for _, msg := range messages {
-			data := []byte(msg.Values["data"].(string))
-			select {
-			case ch <- data: // OK
-			case <-ctx.Done():
-				return
-			}
-		}
-
-		lastSeenID := messages[len(messages)-1].ID
 		for {
-			state, err := hub.ClientState(ctx, id)
+			sub, err := hub.broadcaster.subscribe(ctx, id)
 			if err != nil {
 				return
 			}
-			if state == ClientStateDisconnected {
+			lastSeenID, err = hub.forward(ctx, id, sub, lastSeenID, ch)
+			hub.broadcaster.unsubscribe(id, sub)
+			if err != nil || !sub.lagged {
 				return
 			}
+			// Fell behind the broadcast; resubscribe and catch up from the last seen entry
+		}
+	}()
 
-			args := &redis.XReadArgs{
-				Streams: []string{stream, lastSeenID},
-				Block:   redisReadTimeout,
+	return ch, nil
+}
+
+// forward entries following lastSeenID to the channel, first by reading those which were
+// broadcasted before subscribing directly from the stream and then by relaying the
+// subscription. Returns the ID of the last forwarded entry.
+func (hub *redisHub) forward(ctx context.Context, id string, sub *subscription, lastSeenID string, ch chan<- Entry) (string, error) {
+	messages, err := hub.client.XRange(ctx, streamName(id), lastSeenID, sub.startID).Result()
+	if err != nil {
+		return lastSeenID, err
+	}
+	// Read after the stream so that entries evicted in the meantime are not mistaken
+	// for ones which were evicted before reading
+	trimmedID, err := hub.client.HGet(ctx, metadataKey(id), "trimmed").Result()
+	if err != nil && err != redis.Nil {
+		return lastSeenID, err
+	}
+	if trimmedID != "" && compareStreamIDs(lastSeenID, trimmedID) < 0 &&
+		(len(messages) == 0 || compareStreamIDs(messages[0].ID, trimmedID) > 0) {
+		// The entry following the last seen one has been evicted
+		select {
+		case ch <- Entry{Truncated: true}: // OK
+			lastSeenID = trimmedID
+		case <-ctx.Done():
+			return lastSeenID, ctx.Err()
+		}
+	}
+	for _, msg := range messages {
+		if compareStreamIDs(msg.ID, lastSeenID) <= 0 {
+			continue
+		}
+		select {
+		case ch <- newEntry(msg): // OK
+			lastSeenID = msg.ID
+		case <-ctx.Done():
+			return lastSeenID, ctx.Err()
+		}
+	}
+	for {
+		select {
+		case msg, ok := <-sub.ch:
+			if !ok {
+				return lastSeenID, nil
 			}
-			streamData, err := hub.client.XRead(ctx, args).Result()
-			if err != nil {
-				if err == redis.Nil {
-					continue
-				}
-				return
+			if compareStreamIDs(msg.ID, lastSeenID) <= 0 {
+				continue
 			}
-			messages := streamData[0].Messages
-			lastSeenID = messages[len(messages)-1].ID
-			for _, msg := range messages {
-				data := []byte(msg.Values["data"].(string))
-				select {
-				case ch <- data: // OK
-				case <-ctx.Done():
-					return
-				}
+			select {
+			case ch <- newEntry(msg): // OK
+				lastSeenID = msg.ID
+			case <-ctx.Done():
+				return lastSeenID, ctx.Err()
 			}
+		case <-ctx.Done():
+			return lastSeenID, ctx.Err()
 		}
-	}()
+	}
+}
 
-	return ch, nil
+func newEntry(msg redis.XMessage) Entry {
+	entry := Entry{
+		ID:   msg.ID,
+		Data: []byte(msg.Values["data"].(string)),
+	}
+	// Entries pushed by earlier versions of nacre carry no metadata
+	if v, ok := msg.Values["ts"].(string); ok {
+		ms, _ := strconv.ParseInt(v, 10, 64)
+		entry.Time = time.UnixMilli(ms)
+	}
+	if v, ok := msg.Values["offset"].(string); ok {
+		entry.Offset, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := msg.Values["seq"].(string); ok {
+		entry.Seq, _ = strconv.ParseInt(v, 10, 64)
+	}
+	return entry
 }
 
-func (hub *redisHub) generateExampleData(ctx context.Context) (<-chan []byte, error) {
+func generateExampleData(ctx context.Context, lastID string) (<-chan Entry, error) {
 	// TODO Ensure rate limiter doesn't care about example data
-	ch := make(chan []byte)
+	ch := make(chan Entry)
+	start, _ := strconv.Atoi(lastID)
 
 	go func() {
 		defer close(ch)
-		for _, data := range exampleData {
+		offset := int64(0)
+		for i, data := range exampleData {
+			entryOffset := offset
+			offset += int64(len(data))
+			if i < start {
+				continue
+			}
 			jitter := time.Duration(rand.Intn(350)+50) * time.Millisecond
 			select {
 			case <-time.After(jitter):
@@ -172,8 +384,15 @@ func (hub *redisHub) generateExampleData(ctx context.Context) (<-chan []byte, er
 			case <-ctx.Done():
 				return
 			}
+			entry := Entry{
+				ID:     strconv.Itoa(i + 1),
+				Data:   data,
+				Time:   time.Now(),
+				Offset: entryOffset,
+				Seq:    int64(i + 1),
+			}
 			select {
-			case ch <- data:
+			case ch <- entry:
 			case <-ctx.Done():
 				return
 			}
@@ -183,13 +402,72 @@ func (hub *redisHub) generateExampleData(ctx context.Context) (<-chan []byte, er
 	return ch, nil
 }
 
-func (hub *redisHub) getAllExampleData(ctx context.Context) ([][]byte, error) {
+func getAllExampleData(ctx context.Context) ([][]byte, error) {
 	return exampleData, nil
 }
 
+// getAllExampleEntries returns the example data as if it had been pushed
+// at a steady pace, ending now.
+func getAllExampleEntries(ctx context.Context) ([]Entry, error) {
+	const interval = time.Millisecond * 250
+	start := time.Now().Add(-interval * time.Duration(len(exampleData)))
+	entries := make([]Entry, len(exampleData))
+	offset := int64(0)
+	for i, data := range exampleData {
+		entries[i] = Entry{
+			ID:     strconv.Itoa(i + 1),
+			Data:   data,
+			Time:   start.Add(interval * time.Duration(i)),
+			Offset: offset,
+			Seq:    int64(i + 1),
+		}
+		offset += int64(len(data))
+	}
+	return entries, nil
+}
+
+// getExampleEntriesAfter pages through the example data like GetEntriesAfter.
+func getExampleEntriesAfter(ctx context.Context, afterID string, limit int) ([]Entry, error) {
+	entries, err := getAllExampleEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cursor := 0
+	if afterID != "" {
+		if cursor, err = strconv.Atoi(afterID); err != nil || cursor < 0 {
+			return nil, errInvalidEntryID
+		}
+	}
+	if cursor > len(entries) {
+		cursor = len(entries)
+	}
+	entries = entries[cursor:]
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func getExampleFeedInfo(ctx context.Context) (FeedInfo, error) {
+	entries, err := getAllExampleEntries(ctx)
+	if err != nil || len(entries) == 0 {
+		return FeedInfo{}, err
+	}
+	last := entries[len(entries)-1]
+	bytes := last.Offset + int64(len(last.Data))
+	return FeedInfo{
+		Entries:         int64(len(entries)),
+		Bytes:           bytes,
+		RetainedEntries: int64(len(entries)),
+		RetainedBytes:   bytes,
+		Created:         entries[0].Time,
+		Updated:         last.Time,
+	}, nil
+}
+
 func (hub *redisHub) GetAll(ctx context.Context, id string) ([][]byte, error) {
 	if id == "example" {
-		return hub.getAllExampleData(ctx)
+		return getAllExampleData(ctx)
 	}
 	stream := streamName(id)
 	args := &redis.XReadArgs{
@@ -208,6 +486,80 @@ func (hub *redisHub) GetAll(ctx context.Context, id string) ([][]byte, error) {
 	return results, nil
 }
 
+func (hub *redisHub) GetEntries(ctx context.Context, id string) ([]Entry, error) {
+	if id == "example" {
+		return getAllExampleEntries(ctx)
+	}
+	messages, err := hub.client.XRange(ctx, streamName(id), "-", "+").Result()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Entry, len(messages))
+	for i, msg := range messages {
+		results[i] = newEntry(msg)
+	}
+	return results, nil
+}
+
+func (hub *redisHub) GetEntriesAfter(ctx context.Context, id string, afterID string, limit int) ([]Entry, error) {
+	if id == "example" {
+		return getExampleEntriesAfter(ctx, afterID, limit)
+	}
+	start := "-"
+	if afterID != "" {
+		if _, _, ok := parseStreamID(afterID); !ok {
+			return nil, errInvalidEntryID
+		}
+		start = afterID
+	}
+	// Fetch one more, as the range includes the entry identified by afterID if it still exists
+	messages, err := hub.client.XRangeN(ctx, streamName(id), start, "+", int64(limit)+1).Result()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Entry, 0, len(messages))
+	for _, msg := range messages {
+		if afterID != "" && compareStreamIDs(msg.ID, afterID) <= 0 {
+			continue
+		}
+		if len(results) == limit {
+			break
+		}
+		results = append(results, newEntry(msg))
+	}
+	return results, nil
+}
+
+func (hub *redisHub) FeedInfo(ctx context.Context, id string) (FeedInfo, error) {
+	if id == "example" {
+		return getExampleFeedInfo(ctx)
+	}
+	pipe := hub.client.Pipeline()
+	metaCmd := pipe.HGetAll(ctx, metadataKey(id))
+	lenCmd := pipe.XLen(ctx, streamName(id))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return FeedInfo{}, err
+	}
+	meta := metaCmd.Val()
+	parseInt := func(field string) int64 {
+		v, _ := strconv.ParseInt(meta[field], 10, 64)
+		return v
+	}
+	info := FeedInfo{
+		Entries:         parseInt("seq"),
+		Bytes:           parseInt("bytes"),
+		RetainedEntries: lenCmd.Val(),
+		RetainedBytes:   parseInt("stored"),
+	}
+	if v := parseInt("created"); v > 0 {
+		info.Created = time.UnixMilli(v)
+	}
+	if v := parseInt("updated"); v > 0 {
+		info.Updated = time.UnixMilli(v)
+	}
+	return info, nil
+}
+
 func (hub *redisHub) ClientState(ctx context.Context, id string) (ClientState, error) {
 	state, err := hub.client.Get(ctx, clientKey(id)).Result()
 	if err != nil {
@@ -231,5 +583,7 @@ func (hub *redisHub) ClientDisconnected(ctx context.Context, id string) error {
 	return nil
 }
 
-func streamName(id string) string { return fmt.Sprintf("nacre:feed:%s", id) }
-func clientKey(id string) string  { return fmt.Sprintf("nacre:client:%s", id) }
+func streamName(id string) string     { return fmt.Sprintf("nacre:feed:%s", id) }
+func clientKey(id string) string      { return fmt.Sprintf("nacre:client:%s", id) }
+func metadataKey(id string) string    { return fmt.Sprintf("nacre:meta:%s", id) }
+func reservationKey(id string) string { return fmt.Sprintf("nacre:reserved:%s", id) }
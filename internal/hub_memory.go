@@ -0,0 +1,415 @@
+package nacre
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryFeed is the in-memory state of a single feed.
+//
+// Entries are kept in order of arrival: once their total size exceeds the hub's
+// maximum number of bytes, the oldest ones are evicted. 'total' counts every entry
+// ever pushed to the feed, which lets listeners keep an absolute cursor into the
+// stream even after earlier entries have been evicted.
+type memoryFeed struct {
+	entries []Entry
+	stored  int64 // Number of bytes in 'entries'
+	total   int   // Number of entries ever pushed to this feed
+	bytes   int64 // Number of bytes ever pushed to this feed
+	owner   string
+	secret  string // Hashed secret required to view the feed, if any
+
+	createdAt       time.Time
+	updatedAt       time.Time
+	expiresAt       time.Time
+	clientExpiresAt time.Time
+
+	// notify is closed and replaced whenever the feed changes,
+	// waking up all listeners waiting on it.
+	notify chan empty
+}
+
+func (feed *memoryFeed) push(data []byte, now time.Time, maxBytes int64) {
+	if feed.total == 0 {
+		feed.createdAt = now
+	}
+	feed.updatedAt = now
+	feed.entries = append(feed.entries, Entry{
+		ID:     strconv.Itoa(feed.total + 1),
+		Data:   data,
+		Time:   now,
+		Offset: feed.bytes,
+		Seq:    int64(feed.total + 1),
+	})
+	feed.total++
+	feed.bytes += int64(len(data))
+	feed.stored += int64(len(data))
+	// Evict the oldest entries, but always keep the newest one
+	for feed.stored > maxBytes && len(feed.entries) > 1 {
+		feed.stored -= int64(len(feed.entries[0].Data))
+		feed.entries[0] = Entry{} // Release the evicted data
+		feed.entries = feed.entries[1:]
+	}
+}
+
+// evicted returns the number of entries evicted from the start of the feed.
+func (feed *memoryFeed) evicted() int { return feed.total - len(feed.entries) }
+
+// since returns the entries pushed after the absolute 'cursor' position,
+// along with the cursor position following the last returned entry.
+// If entries following the cursor have been evicted, the results start with
+// a Truncated entry in their place.
+//
+// An entry's ID is its sequence number, i.e. its 1-based absolute position in
+// the feed, so the ID of the last seen entry doubles as the cursor for resuming after it.
+func (feed *memoryFeed) since(cursor int) ([]Entry, int) {
+	oldest := feed.evicted()
+	results := make([]Entry, 0, len(feed.entries)+1)
+	if cursor < oldest {
+		results = append(results, Entry{Truncated: true})
+		cursor = oldest
+	} else if cursor > feed.total {
+		cursor = feed.total
+	}
+	results = append(results, feed.entries[cursor-oldest:]...)
+	return results, feed.total
+}
+
+func (feed *memoryFeed) wake() {
+	close(feed.notify)
+	feed.notify = make(chan empty)
+}
+
+// memoryHub is a Hub implementation which keeps all feed data and client state
+// in the memory of the current process. It allows running nacre as a single binary
+// without any external dependencies, at the cost of losing all feeds on restart
+// and being unable to share feeds between horizontally-scaled instances.
+type memoryHub struct {
+	mu    sync.Mutex
+	feeds map[string]*memoryFeed
+
+	maxStreamBytes               int64
+	maxStreamPersistenceDuration time.Duration
+
+	gcPeriod time.Duration
+	quit     chan empty
+}
+
+var _ Hub = (*memoryHub)(nil)
+
+// NewMemoryHub allocates a new memory-backed hub implementation. It also spins off
+// a new background goroutine which periodically removes expired feeds.
+func NewMemoryHub(maxStreamBytes int64, maxStreamPersistenceDuration time.Duration) Hub {
+	hub := &memoryHub{
+		mu:                           sync.Mutex{},
+		feeds:                        make(map[string]*memoryFeed),
+		maxStreamBytes:               maxStreamBytes,
+		maxStreamPersistenceDuration: maxStreamPersistenceDuration,
+		gcPeriod:                     time.Second * 30,
+		quit:                         make(chan empty),
+	}
+	go hub.garbageCollectLoop(context.Background())
+	return hub
+}
+
+// feed returns the identified feed, or nil if it does not exist or has expired.
+// Callers must hold hub.mu.
+func (hub *memoryHub) feed(id string) *memoryFeed {
+	feed, ok := hub.feeds[id]
+	if !ok || time.Now().After(feed.expiresAt) {
+		return nil
+	}
+	return feed
+}
+
+// getOrCreateFeed returns the identified feed, allocating it if needed.
+// Callers must hold hub.mu.
+func (hub *memoryHub) getOrCreateFeed(id string) *memoryFeed {
+	if feed := hub.feed(id); feed != nil {
+		return feed
+	}
+	if feed, ok := hub.feeds[id]; ok {
+		// Wake up listeners of the expired feed before replacing it
+		feed.wake()
+	}
+	feed := &memoryFeed{
+		notify: make(chan empty),
+	}
+	hub.feeds[id] = feed
+	return feed
+}
+
+// Ping always succeeds, as the memory hub has no external backend.
+func (hub *memoryHub) Ping(ctx context.Context) error { return nil }
+
+// Close stops the background garbage collection goroutine.
+func (hub *memoryHub) Close() error {
+	close(hub.quit)
+	return nil
+}
+
+func (hub *memoryHub) FeedExists(ctx context.Context, id string) (bool, error) {
+	if id == "example" {
+		return true, nil
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	feed := hub.feed(id)
+	return feed != nil && feed.total > 0, nil
+}
+
+func (hub *memoryHub) ReserveFeed(ctx context.Context, id string, owner string) (bool, error) {
+	if id == "example" {
+		return false, nil
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if feed := hub.feed(id); feed != nil {
+		return false, nil
+	}
+	feed := hub.getOrCreateFeed(id)
+	feed.owner = owner
+	feed.expiresAt = time.Now().Add(hub.maxStreamPersistenceDuration)
+	return true, nil
+}
+
+func (hub *memoryHub) FeedOwner(ctx context.Context, id string) (string, error) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	feed := hub.feed(id)
+	if feed == nil {
+		return "", nil
+	}
+	return feed.owner, nil
+}
+
+func (hub *memoryHub) SetFeedSecret(ctx context.Context, id string, secret string) error {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	feed := hub.getOrCreateFeed(id)
+	feed.secret = secret
+	if expiresAt := time.Now().Add(hub.maxStreamPersistenceDuration); feed.expiresAt.Before(expiresAt) {
+		feed.expiresAt = expiresAt
+	}
+	return nil
+}
+
+func (hub *memoryHub) FeedSecret(ctx context.Context, id string) (string, error) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	feed := hub.feed(id)
+	if feed == nil {
+		return "", nil
+	}
+	return feed.secret, nil
+}
+
+func (hub *memoryHub) Push(ctx context.Context, id string, data []byte) error {
+	// Callers are free to reuse their buffers, so keep our own copy of the data
+	owned := make([]byte, len(data))
+	copy(owned, data)
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	now := time.Now()
+	feed := hub.getOrCreateFeed(id)
+	feed.push(owned, now, hub.maxStreamBytes)
+	// Refresh expiration for this feed
+	feed.expiresAt = now.Add(hub.maxStreamPersistenceDuration)
+	feed.wake()
+	return nil
+}
+
+func (hub *memoryHub) Listen(ctx context.Context, id string, lastID string) (<-chan Entry, error) {
+	if id == "example" {
+		return generateExampleData(ctx, lastID)
+	}
+
+	ch := make(chan Entry)
+
+	go func() {
+		defer close(ch)
+
+		cursor, err := strconv.Atoi(lastID)
+		if err != nil || cursor < 0 {
+			// Invalid IDs are listened to from the start of the feed
+			cursor = 0
+		}
+		for {
+			hub.mu.Lock()
+			feed := hub.feed(id)
+			if feed == nil {
+				hub.mu.Unlock()
+				return
+			}
+			entries, next := feed.since(cursor)
+			notify := feed.notify
+			connected := time.Now().Before(feed.clientExpiresAt)
+			hub.mu.Unlock()
+
+			cursor = next
+			for _, entry := range entries {
+				select {
+				case ch <- entry: // OK
+				case <-ctx.Done():
+					return
+				}
+			}
+			if !connected {
+				return
+			}
+
+			select {
+			case <-notify: // Feed updated
+			case <-time.After(memoryPollPeriod): // Re-check client state
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (hub *memoryHub) GetAll(ctx context.Context, id string) ([][]byte, error) {
+	if id == "example" {
+		return getAllExampleData(ctx)
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	feed := hub.feed(id)
+	if feed == nil {
+		return [][]byte{}, nil
+	}
+	results := make([][]byte, len(feed.entries))
+	for i, entry := range feed.entries {
+		results[i] = entry.Data
+	}
+	return results, nil
+}
+
+func (hub *memoryHub) GetEntries(ctx context.Context, id string) ([]Entry, error) {
+	if id == "example" {
+		return getAllExampleEntries(ctx)
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	feed := hub.feed(id)
+	if feed == nil {
+		return []Entry{}, nil
+	}
+	entries := make([]Entry, len(feed.entries))
+	copy(entries, feed.entries)
+	return entries, nil
+}
+
+func (hub *memoryHub) GetEntriesAfter(ctx context.Context, id string, afterID string, limit int) ([]Entry, error) {
+	if id == "example" {
+		return getExampleEntriesAfter(ctx, afterID, limit)
+	}
+	cursor := 0
+	if afterID != "" {
+		var err error
+		if cursor, err = strconv.Atoi(afterID); err != nil || cursor < 0 {
+			return nil, errInvalidEntryID
+		}
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	feed := hub.feed(id)
+	if feed == nil {
+		return []Entry{}, nil
+	}
+	entries, _ := feed.since(cursor)
+	if len(entries) > 0 && entries[0].Truncated {
+		entries = entries[1:]
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (hub *memoryHub) FeedInfo(ctx context.Context, id string) (FeedInfo, error) {
+	if id == "example" {
+		return getExampleFeedInfo(ctx)
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	feed := hub.feed(id)
+	if feed == nil || feed.total == 0 {
+		return FeedInfo{}, nil
+	}
+	return FeedInfo{
+		Entries:         int64(feed.total),
+		Bytes:           feed.bytes,
+		RetainedEntries: int64(len(feed.entries)),
+		RetainedBytes:   feed.stored,
+		Created:         feed.createdAt,
+		Updated:         feed.updatedAt,
+	}, nil
+}
+
+func (hub *memoryHub) ClientState(ctx context.Context, id string) (ClientState, error) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	feed := hub.feed(id)
+	if feed == nil || time.Now().After(feed.clientExpiresAt) {
+		return ClientStateDisconnected, nil
+	}
+	return ClientStateConnected, nil
+}
+
+func (hub *memoryHub) ClientConnected(ctx context.Context, id string) error {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	feed := hub.getOrCreateFeed(id)
+	feed.clientExpiresAt = time.Now().Add(clientConnectedDuration)
+	if feed.expiresAt.Before(feed.clientExpiresAt) {
+		// Keep feeds around for at least as long as their client is connected
+		feed.expiresAt = feed.clientExpiresAt
+	}
+	return nil
+}
+
+func (hub *memoryHub) ClientDisconnected(ctx context.Context, id string) error {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	feed := hub.feed(id)
+	if feed == nil {
+		return nil
+	}
+	feed.clientExpiresAt = time.Time{}
+	feed.wake()
+	return nil
+}
+
+func (hub *memoryHub) garbageCollectLoop(ctx context.Context) {
+	ticker := time.NewTicker(hub.gcPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hub.quit:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			hub.garbageCollect()
+		}
+	}
+}
+
+func (hub *memoryHub) garbageCollect() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	now := time.Now()
+	for id, feed := range hub.feeds {
+		if now.After(feed.expiresAt) && now.After(feed.clientExpiresAt) {
+			feed.wake()
+			delete(hub.feeds, id)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package nacre
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// truncatedID stands in for Truncated entries in the expected entry IDs.
+const truncatedID = "~"
+
+func entryIDs(entries []Entry) []string {
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Truncated {
+			ids = append(ids, truncatedID)
+			continue
+		}
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+func TestMemoryFeedSince(t *testing.T) {
+	tests := []struct {
+		name       string
+		chunks     []string
+		maxBytes   int64
+		cursor     int
+		wantIDs    []string
+		wantCursor int
+	}{
+		{name: "empty feed", chunks: nil, maxBytes: 10, cursor: 0, wantIDs: []string{}, wantCursor: 0},
+		{name: "from start", chunks: []string{"ab", "cd", "ef"}, maxBytes: 10, cursor: 0, wantIDs: []string{"1", "2", "3"}, wantCursor: 3},
+		{name: "after cursor", chunks: []string{"ab", "cd", "ef"}, maxBytes: 10, cursor: 2, wantIDs: []string{"3"}, wantCursor: 3},
+		{name: "caught up", chunks: []string{"ab", "cd", "ef"}, maxBytes: 10, cursor: 3, wantIDs: []string{}, wantCursor: 3},
+		{name: "cursor past end", chunks: []string{"ab"}, maxBytes: 10, cursor: 7, wantIDs: []string{}, wantCursor: 1},
+		{name: "evicted before cursor", chunks: []string{"ab", "cd", "ef", "gh"}, maxBytes: 4, cursor: 2, wantIDs: []string{"3", "4"}, wantCursor: 4},
+		{name: "evicted after cursor", chunks: []string{"ab", "cd", "ef", "gh"}, maxBytes: 4, cursor: 1, wantIDs: []string{truncatedID, "3", "4"}, wantCursor: 4},
+		{name: "evicted from start", chunks: []string{"ab", "cd", "ef", "gh"}, maxBytes: 5, cursor: 0, wantIDs: []string{truncatedID, "3", "4"}, wantCursor: 4},
+		{name: "newest entry is kept", chunks: []string{"ab", "cdefgh"}, maxBytes: 4, cursor: 0, wantIDs: []string{truncatedID, "2"}, wantCursor: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feed := &memoryFeed{notify: make(chan empty)}
+			for _, chunk := range tt.chunks {
+				feed.push([]byte(chunk), time.Now(), tt.maxBytes)
+			}
+			entries, cursor := feed.since(tt.cursor)
+			if ids := entryIDs(entries); !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("since(%d) = %v, want %v", tt.cursor, ids, tt.wantIDs)
+			}
+			if cursor != tt.wantCursor {
+				t.Errorf("since(%d) cursor = %d, want %d", tt.cursor, cursor, tt.wantCursor)
+			}
+			var stored int64
+			for _, entry := range feed.entries {
+				stored += int64(len(entry.Data))
+			}
+			if stored != feed.stored {
+				t.Errorf("stored = %d, want %d", feed.stored, stored)
+			}
+		})
+	}
+}
+
+func TestMemoryHubListen(t *testing.T) {
+	tests := []struct {
+		name     string
+		chunks   []string
+		maxBytes int64
+		lastID   string
+		wantIDs  []string
+	}{
+		{name: "from start", chunks: []string{"ab", "cd", "ef"}, maxBytes: 10, lastID: "", wantIDs: []string{"1", "2", "3"}},
+		{name: "resume", chunks: []string{"ab", "cd", "ef"}, maxBytes: 10, lastID: "2", wantIDs: []string{"3"}},
+		{name: "invalid ID", chunks: []string{"ab", "cd"}, maxBytes: 10, lastID: "abc", wantIDs: []string{"1", "2"}},
+		{name: "negative ID", chunks: []string{"ab", "cd"}, maxBytes: 10, lastID: "-1", wantIDs: []string{"1", "2"}},
+		{name: "resume after eviction", chunks: []string{"ab", "cd", "ef"}, maxBytes: 4, lastID: "0", wantIDs: []string{truncatedID, "2", "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			hub := NewMemoryHub(tt.maxBytes, time.Hour)
+			defer hub.Close()
+			for _, chunk := range tt.chunks {
+				if err := hub.Push(ctx, "feed", []byte(chunk)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The feed's client never connected, so listening ends once all entries are read
+			ch, err := hub.Listen(ctx, "feed", tt.lastID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var entries []Entry
+			for entry := range ch {
+				entries = append(entries, entry)
+			}
+			if ids := entryIDs(entries); !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("Listen(%q) = %v, want %v", tt.lastID, ids, tt.wantIDs)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package nacre
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v9"
+)
+
+// newTestRedisHub returns a Redis-backed hub which is served by an in-process miniredis server.
+func newTestRedisHub(t *testing.T, maxStreamBytes int64) (*redisHub, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	hub := NewRedisHub(client, maxStreamBytes, time.Hour).(*redisHub)
+	t.Cleanup(func() { hub.Close() })
+	return hub, server
+}
+
+// receiveEntries reads n entries from the channel, failing the test if they don't arrive in time.
+func receiveEntries(t *testing.T, ch <-chan Entry, n int) []Entry {
+	t.Helper()
+	timeout := time.After(time.Second * 5)
+	entries := make([]Entry, 0, n)
+	for len(entries) < n {
+		select {
+		case entry, ok := <-ch:
+			if !ok {
+				t.Fatalf("channel closed after %d of %d entries", len(entries), n)
+			}
+			entries = append(entries, entry)
+		case <-timeout:
+			t.Fatalf("received %d of %d entries before timing out", len(entries), n)
+		}
+	}
+	return entries
+}
+
+// pushChunks pushes each chunk as a separate entry of the feed.
+func pushChunks(t *testing.T, hub Hub, id string, chunks ...string) {
+	t.Helper()
+	for _, chunk := range chunks {
+		if err := hub.Push(context.Background(), id, []byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRedisHubReserveFeed(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		setup     func(t *testing.T, hub *redisHub, server *miniredis.Miniredis)
+		want      bool
+		wantOwner string
+	}{
+		{
+			name:      "unused name",
+			setup:     func(t *testing.T, hub *redisHub, server *miniredis.Miniredis) {},
+			want:      true,
+			wantOwner: "owner",
+		},
+		{
+			name: "reserved name",
+			setup: func(t *testing.T, hub *redisHub, server *miniredis.Miniredis) {
+				if ok, err := hub.ReserveFeed(ctx, "feed", "other"); err != nil || !ok {
+					t.Fatalf("ReserveFeed() = %t, %v", ok, err)
+				}
+			},
+			want:      false,
+			wantOwner: "other",
+		},
+		{
+			name: "existing feed",
+			setup: func(t *testing.T, hub *redisHub, server *miniredis.Miniredis) {
+				pushChunks(t, hub, "feed", "data")
+			},
+			want:      false,
+			wantOwner: "",
+		},
+		{
+			name: "expired reservation",
+			setup: func(t *testing.T, hub *redisHub, server *miniredis.Miniredis) {
+				if ok, err := hub.ReserveFeed(ctx, "feed", "other"); err != nil || !ok {
+					t.Fatalf("ReserveFeed() = %t, %v", ok, err)
+				}
+				server.FastForward(time.Hour)
+			},
+			want:      true,
+			wantOwner: "owner",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub, server := newTestRedisHub(t, 1024*1024)
+			tt.setup(t, hub, server)
+			got, err := hub.ReserveFeed(ctx, "feed", "owner")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ReserveFeed() = %t, want %t", got, tt.want)
+			}
+			owner, err := hub.FeedOwner(ctx, "feed")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if owner != tt.wantOwner {
+				t.Errorf("FeedOwner() = %q, want %q", owner, tt.wantOwner)
+			}
+		})
+	}
+}
+
+// pushChunkIDs pushes each chunk as a separate entry of the feed, returning the entries' IDs.
+func pushChunkIDs(t *testing.T, hub *redisHub, id string, chunks ...string) []string {
+	t.Helper()
+	ids := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		pushChunks(t, hub, id, chunk)
+		messages, err := hub.client.XRevRangeN(context.Background(), streamName(id), "+", "-", 1).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = messages[0].ID
+	}
+	return ids
+}
+
+func TestRedisHubPushEviction(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name        string
+		chunks      []string
+		maxBytes    int64
+		wantData    []string
+		wantTrimmed int // Index of the newest evicted chunk, or -1 if none were evicted
+	}{
+		{name: "within limit", chunks: []string{"ab", "cd", "ef"}, maxBytes: 6, wantData: []string{"ab", "cd", "ef"}, wantTrimmed: -1},
+		{name: "oldest evicted first", chunks: []string{"ab", "cd", "ef", "gh"}, maxBytes: 5, wantData: []string{"ef", "gh"}, wantTrimmed: 1},
+		{name: "evicted until it fits", chunks: []string{"ab", "cd", "efgh"}, maxBytes: 5, wantData: []string{"efgh"}, wantTrimmed: 1},
+		{name: "newest entry is kept", chunks: []string{"ab", "cdefgh"}, maxBytes: 4, wantData: []string{"cdefgh"}, wantTrimmed: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub, _ := newTestRedisHub(t, tt.maxBytes)
+			ids := pushChunkIDs(t, hub, "feed", tt.chunks...)
+			entries, err := hub.GetEntries(ctx, "feed")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var data []string
+			var stored int64
+			for _, entry := range entries {
+				data = append(data, string(entry.Data))
+				stored += int64(len(entry.Data))
+			}
+			if !reflect.DeepEqual(data, tt.wantData) {
+				t.Errorf("retained %q, want %q", data, tt.wantData)
+			}
+			if len(entries) > 1 && stored > tt.maxBytes {
+				t.Errorf("retained %d bytes, want at most %d", stored, tt.maxBytes)
+			}
+			meta, err := hub.client.HGetAll(ctx, metadataKey("feed")).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta["stored"] != strconv.FormatInt(stored, 10) {
+				t.Errorf("stored = %s, want %d", meta["stored"], stored)
+			}
+			wantTrimmed := ""
+			if tt.wantTrimmed >= 0 {
+				wantTrimmed = ids[tt.wantTrimmed]
+			}
+			if meta["trimmed"] != wantTrimmed {
+				t.Errorf("trimmed = %q, want %q", meta["trimmed"], wantTrimmed)
+			}
+		})
+	}
+}
+
+func TestRedisHubListenTruncated(t *testing.T) {
+	tests := []struct {
+		name     string
+		chunks   []string
+		maxBytes int64
+		lastSeen int // Index of the chunk to resume after, or -1 to listen from the start
+		wantData []string
+	}{
+		{name: "from start", chunks: []string{"ab", "cd", "ef"}, maxBytes: 10, lastSeen: -1, wantData: []string{"ab", "cd", "ef"}},
+		{name: "from start after eviction", chunks: []string{"ab", "cd", "ef"}, maxBytes: 4, lastSeen: -1, wantData: []string{truncatedID, "cd", "ef"}},
+		{name: "resume at eviction", chunks: []string{"ab", "cd", "ef"}, maxBytes: 4, lastSeen: 0, wantData: []string{"cd", "ef"}},
+		{name: "resume before eviction", chunks: []string{"ab", "cd", "ef"}, maxBytes: 2, lastSeen: 0, wantData: []string{truncatedID, "ef"}},
+		{name: "resume after eviction", chunks: []string{"ab", "cd", "ef"}, maxBytes: 2, lastSeen: 1, wantData: []string{"ef"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			hub, _ := newTestRedisHub(t, tt.maxBytes)
+			ids := pushChunkIDs(t, hub, "feed", tt.chunks...)
+			lastID := ""
+			if tt.lastSeen >= 0 {
+				lastID = ids[tt.lastSeen]
+			}
+			ch, err := hub.Listen(ctx, "feed", lastID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var data []string
+			for _, entry := range receiveEntries(t, ch, len(tt.wantData)) {
+				if entry.Truncated {
+					data = append(data, truncatedID)
+					continue
+				}
+				data = append(data, string(entry.Data))
+			}
+			if !reflect.DeepEqual(data, tt.wantData) {
+				t.Errorf("Listen(%q) = %q, want %q", lastID, data, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestRedisHubListenTruncatedWhileListening(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub, _ := newTestRedisHub(t, 4)
+	if err := hub.ClientConnected(ctx, "feed"); err != nil {
+		t.Fatal(err)
+	}
+	pushChunks(t, hub, "feed", "ab")
+	ch, err := hub.Listen(ctx, "feed", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := receiveEntries(t, ch, 1); string(entries[0].Data) != "ab" {
+		t.Fatalf("received %q, want \"ab\"", entries[0].Data)
+	}
+	// Entries are relayed to listeners as they are pushed, even if they are evicted right after
+	pushChunks(t, hub, "feed", "cd", "ef", "gh")
+	var data []string
+	for _, entry := range receiveEntries(t, ch, 3) {
+		data = append(data, string(entry.Data))
+	}
+	if want := []string{"cd", "ef", "gh"}; !reflect.DeepEqual(data, want) {
+		t.Errorf("received %q, want %q", data, want)
+	}
+}
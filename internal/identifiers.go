@@ -1,9 +1,17 @@
 package nacre
 
 import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"math/rand"
 	"time"
 	"unsafe"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 var defaultRandSrc = rand.NewSource(time.Now().UnixNano())
@@ -34,3 +42,74 @@ func NewRandString(src rand.Source, n int) string {
 
 	return *(*string)(unsafe.Pointer(&b))
 }
+
+// newOwnerToken returns a new secret token which lets a client prove ownership of a feed.
+// Unlike NewRandString, it is generated from a cryptographically secure source.
+func newOwnerToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashOwnerToken returns the hash of an owner token, which is what the Hub stores.
+func hashOwnerToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyOwnerToken returns true if the token matches the stored owner hash.
+func verifyOwnerToken(token string, owner string) bool {
+	if token == "" || owner == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashOwnerToken(token)), []byte(owner)) == 1
+}
+
+// sshOwner returns the owner recorded for feeds created over SSH, which are owned by
+// the client's public key rather than a token. The prefix keeps owner tokens, whose
+// hashes are hex-encoded, from ever matching it.
+func sshOwner(fingerprint string) string {
+	return "ssh:" + fingerprint
+}
+
+// verifySSHOwner returns true if the feed's stored owner is the public key with the fingerprint.
+func verifySSHOwner(fingerprint string, owner string) bool {
+	if fingerprint == "" || owner == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(sshOwner(fingerprint)), []byte(owner)) == 1
+}
+
+// hashFeedPassword returns the secret which the Hub stores for a password-protected feed.
+// Unlike owner tokens, passwords are chosen by people and hence hashed with bcrypt.
+func hashFeedPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// verifyFeedPassword returns true if the password matches the feed's stored secret.
+func verifyFeedPassword(password string, secret string) bool {
+	if password == "" || secret == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(secret), []byte(password)) == nil
+}
+
+// feedViewKey returns the key which lets a viewer who entered a feed's password keep
+// viewing the feed without entering it again. Keys are derived from the feed's secret,
+// so changing the password revokes all previously issued keys.
+func feedViewKey(id string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyFeedViewKey returns true if the key was issued for the feed's current secret.
+func verifyFeedViewKey(id string, secret string, key string) bool {
+	if key == "" || secret == "" {
+		return false
+	}
+	return hmac.Equal([]byte(feedViewKey(id, secret)), []byte(key))
+}
@@ -0,0 +1,112 @@
+package nacre
+
+import "testing"
+
+func TestVerifyOwnerToken(t *testing.T) {
+	token, err := newOwnerToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := hashOwnerToken(token)
+	tests := []struct {
+		name  string
+		token string
+		owner string
+		want  bool
+	}{
+		{name: "matching token", token: token, owner: owner, want: true},
+		{name: "other token", token: token + "x", owner: owner, want: false},
+		{name: "hash as token", token: owner, owner: owner, want: false},
+		{name: "empty token", token: "", owner: hashOwnerToken(""), want: false},
+		{name: "no owner", token: token, owner: "", want: false},
+		{name: "SSH owner", token: token, owner: sshOwner("SHA256:abc"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyOwnerToken(tt.token, tt.owner); got != tt.want {
+				t.Errorf("verifyOwnerToken() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifySSHOwner(t *testing.T) {
+	tests := []struct {
+		name        string
+		fingerprint string
+		owner       string
+		want        bool
+	}{
+		{name: "matching key", fingerprint: "SHA256:abc", owner: sshOwner("SHA256:abc"), want: true},
+		{name: "other key", fingerprint: "SHA256:abd", owner: sshOwner("SHA256:abc"), want: false},
+		{name: "empty fingerprint", fingerprint: "", owner: sshOwner(""), want: false},
+		{name: "token owner", fingerprint: "SHA256:abc", owner: hashOwnerToken("SHA256:abc"), want: false},
+		{name: "no owner", fingerprint: "SHA256:abc", owner: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifySSHOwner(tt.fingerprint, tt.owner); got != tt.want {
+				t.Errorf("verifySSHOwner() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyFeedPassword(t *testing.T) {
+	secret, err := hashFeedPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		password string
+		secret   string
+		want     bool
+	}{
+		{name: "correct password", password: "hunter2", secret: secret, want: true},
+		{name: "incorrect password", password: "hunter3", secret: secret, want: false},
+		{name: "empty password", password: "", secret: secret, want: false},
+		{name: "secret as password", password: secret, secret: secret, want: false},
+		{name: "public feed", password: "hunter2", secret: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyFeedPassword(tt.password, tt.secret); got != tt.want {
+				t.Errorf("verifyFeedPassword(%q) = %t, want %t", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyFeedViewKey(t *testing.T) {
+	secret, err := hashFeedPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSecret, err := hashFeedPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := feedViewKey("feed", secret)
+	tests := []struct {
+		name   string
+		id     string
+		secret string
+		key    string
+		want   bool
+	}{
+		{name: "issued key", id: "feed", secret: secret, key: key, want: true},
+		{name: "other feed", id: "other", secret: secret, key: key, want: false},
+		{name: "password changed", id: "feed", secret: newSecret, key: key, want: false},
+		{name: "password as key", id: "feed", secret: secret, key: "hunter2", want: false},
+		{name: "empty key", id: "feed", secret: secret, key: "", want: false},
+		{name: "public feed", id: "feed", secret: "", key: feedViewKey("feed", ""), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyFeedViewKey(tt.id, tt.secret, tt.key); got != tt.want {
+				t.Errorf("verifyFeedViewKey() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package nacre
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	clientConnectedHeartbeat = time.Second * 2
+
+	maxReserveAttempts = 10
+)
+
+var (
+	errFeedNameTaken     = errors.New("feed name taken")
+	errInvalidOwnerToken = errors.New("invalid owner token")
+)
+
+// ingester pushes producers' data streams to the hub, regardless of
+// the protocol they were received over.
+type ingester struct {
+	hub         Hub
+	rateLimiter RateLimiter
+	bandwidth   BandwidthLimiter
+	baseURL     string
+	bufsize     int
+}
+
+func newIngester(baseURL string, hub Hub, rateLimiter RateLimiter, bandwidth BandwidthLimiter) *ingester {
+	return &ingester{
+		hub:         hub,
+		rateLimiter: rateLimiter,
+		bandwidth:   bandwidth,
+		baseURL:     baseURL,
+		bufsize:     1024 * 2,
+	}
+}
+
+// ingest reads the producer's data stream and pushes it to the feed until the stream
+// ends or the quit channel is closed, keeping the feed marked as connected meanwhile.
+// Bandwidth is limited per client ID, which is either the client's IP or another identity.
+// Notices about throttling and quotas are written to the producer through 'notices'.
+//
+// The feed is marked as disconnected once ingest returns, unless the stream failed
+// unexpectedly. Such failures may just be network blips, so the producer gets a chance
+// to reattach before its heartbeat expires.
+func (in *ingester) ingest(ctx context.Context, quit <-chan empty, sid string, clientID string, stream io.Reader, notices io.Writer) {
+	heartbeatCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	reattachable := false
+	defer func() {
+		if !reattachable {
+			in.hub.ClientDisconnected(ctx, sid)
+		}
+	}()
+	go func(ctx context.Context) {
+		heartbeat := time.NewTicker(clientConnectedHeartbeat)
+		defer heartbeat.Stop()
+		_ = in.hub.ClientConnected(ctx, sid)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-quit:
+				return
+			case <-heartbeat.C:
+				_ = in.hub.ClientConnected(ctx, sid)
+			}
+		}
+	}(heartbeatCtx)
+
+	shuttingDown := func() bool {
+		select {
+		case <-quit:
+			return true
+		default:
+			return false
+		}
+	}
+
+	buf := make([]byte, in.bufsize) // NOTE: Could consider buffer pool to limit memory usage
+	throttled := false
+	var streamed int64 // Bytes of the stream pushed to the feed
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-quit:
+			return
+		default: // Continue serving client
+		}
+		nbytes, err := stream.Read(buf)
+		if nbytes == 0 && err != nil {
+			reattachable = !errors.Is(err, io.EOF) && !shuttingDown()
+			if errors.Is(err, os.ErrDeadlineExceeded) && !shuttingDown() {
+				notices.Write([]byte("\nnacre: no data received for too long, closing your stream\n"))
+			}
+			return
+		}
+		if nbytes == 0 {
+			continue
+		}
+		delay, err := in.bandwidth.Reserve(clientID, nbytes)
+		if errors.Is(err, errDailyQuotaExceeded) {
+			// The chunk which exceeded the quota is dropped, so tell the producer where its output was cut off
+			notices.Write([]byte(fmt.Sprintf(
+				"\nnacre: daily data quota for your IP is exhausted, only the first %d bytes you sent were streamed, try again tomorrow (UTC)\n",
+				streamed,
+			)))
+			return
+		}
+		if delay > 0 {
+			if !throttled {
+				notices.Write([]byte("\nnacre: bandwidth limit for your IP reached, throttling your stream\n"))
+				throttled = true
+			}
+			// Not reading from the stream in the meantime applies backpressure to the client
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-quit:
+				timer.Stop()
+				return
+			}
+		}
+		if err := in.hub.Push(ctx, sid, buf[0:nbytes]); err != nil {
+			log.Printf("Failed to push data: %s", err)
+			return
+		}
+		streamed += int64(nbytes)
+	}
+}
+
+// idleReader extends the read deadline of the producer's connection before every read,
+// so that producers which stop sending without closing their connection are let go.
+//
+// Servers which unblock pending reads on shutdown by forcing the deadline set 'quit',
+// so that the forced deadline is not extended again.
+type idleReader struct {
+	reader          io.Reader
+	setReadDeadline func(time.Time) error
+	timeout         time.Duration
+	quit            <-chan empty
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	_ = r.setReadDeadline(time.Now().Add(r.timeout))
+	select {
+	case <-r.quit:
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	return r.reader.Read(p)
+}
+
+// openFeed reserves a new feed for the client, or reattaches the client to an existing feed
+// if it presented the feed's owner token or, over SSH, the feed's owning key, and protects
+// the feed with the client's password if it set one. Returns the feed's ID, the client's
+// owner token if a new token-owned feed was reserved, and the client's greeting.
+func (in *ingester) openFeed(ctx context.Context, hs handshake) (string, string, string, error) {
+	sid, token, msg, err := in.claimFeed(ctx, hs)
+	if err != nil || hs.password == "" {
+		return sid, token, msg, err
+	}
+	if err := in.protectFeed(ctx, sid, hs.password); err != nil {
+		return "", "", "", err
+	}
+	return sid, token, msg + "Password protected: viewers must enter your password to see the feed\n", nil
+}
+
+// protectFeed sets the password which viewers must enter to see the feed. Reattaching
+// clients which send the feed's current password keep its secret, so that viewers who
+// already entered the password don't have to enter it again.
+func (in *ingester) protectFeed(ctx context.Context, sid string, password string) error {
+	secret, err := in.hub.FeedSecret(ctx, sid)
+	if err != nil {
+		return err
+	}
+	if verifyFeedPassword(password, secret) {
+		return nil
+	}
+	if secret, err = hashFeedPassword(password); err != nil {
+		return err
+	}
+	return in.hub.SetFeedSecret(ctx, sid, secret)
+}
+
+// claimFeed reserves or reattaches to the client's feed, as described by openFeed.
+func (in *ingester) claimFeed(ctx context.Context, hs handshake) (string, string, string, error) {
+	if hs.feed != "" {
+		owner, err := in.hub.FeedOwner(ctx, hs.feed)
+		if err != nil {
+			return "", "", "", err
+		}
+		verified := verifyOwnerToken(hs.token, owner)
+		if hs.identity != "" {
+			verified = verifySSHOwner(hs.identity, owner)
+		}
+		if !verified {
+			return "", "", "", errInvalidOwnerToken
+		}
+		msg := fmt.Sprintf("Reattached to nacre. Serving at: %s\n", liveFeedURL(in.baseURL, hs.feed))
+		return hs.feed, "", msg, nil
+	}
+
+	if hs.identity != "" {
+		sid, err := in.reserveFeed(ctx, hs.name, sshOwner(hs.identity))
+		if err != nil {
+			return "", "", "", err
+		}
+		msg := fmt.Sprintf(
+			"Connected to nacre. Serving at: %s\nOwned by your SSH key %s (run \"%s=%s\" to reattach)\n",
+			liveFeedURL(in.baseURL, sid), hs.identity, handshakeOptionFeed, sid,
+		)
+		return sid, "", msg, nil
+	}
+
+	token, err := newOwnerToken()
+	if err != nil {
+		return "", "", "", err
+	}
+	sid, err := in.reserveFeed(ctx, hs.name, hashOwnerToken(token))
+	if err != nil {
+		return "", "", "", err
+	}
+	msg := fmt.Sprintf(
+		"Connected to nacre. Serving at: %s\nOwner token: %s (send \"%sfeed=%s token=%s\" to reattach)\n",
+		liveFeedURL(in.baseURL, sid), token, handshakePrefix, sid, token,
+	)
+	return sid, token, msg, nil
+}
+
+// reserveFeed reserves the requested feed name, or a random feed ID if no name is requested.
+func (in *ingester) reserveFeed(ctx context.Context, name string, owner string) (string, error) {
+	if name != "" {
+		if ok, err := in.hub.ReserveFeed(ctx, name, owner); err != nil {
+			return "", err
+		} else if !ok {
+			return "", errFeedNameTaken
+		}
+		return name, nil
+	}
+	for i := 0; i < maxReserveAttempts; i++ {
+		id := NewRandString(defaultRandSrc, 6)
+		if ok, err := in.hub.ReserveFeed(ctx, id, owner); err != nil {
+			return "", err
+		} else if ok {
+			return id, nil
+		}
+	}
+	return "", errors.New("exhausted attempts to reserve random feed ID")
+}
+
+// openFeedError describes the openFeed error to the client.
+func openFeedError(err error, hs handshake) string {
+	switch {
+	case errors.Is(err, errFeedNameTaken):
+		return fmt.Sprintf("feed name %q is already taken", hs.name)
+	case errors.Is(err, errInvalidOwnerToken) && hs.identity != "":
+		return fmt.Sprintf("feed %q is not owned by your SSH key", hs.feed)
+	case errors.Is(err, errInvalidOwnerToken):
+		return fmt.Sprintf("invalid owner token for feed %q", hs.feed)
+	default:
+		log.Printf("error: openFeed: %s\n", err.Error())
+		return "internal error"
+	}
+}
@@ -0,0 +1,150 @@
+package nacre
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHubs returns a hub of each backend, keyed by the backend's name.
+func testHubs(t *testing.T) map[string]Hub {
+	t.Helper()
+	memoryHub := NewMemoryHub(1024*1024, time.Hour)
+	t.Cleanup(func() { memoryHub.Close() })
+	redisHub, _ := newTestRedisHub(t, 1024*1024)
+	return map[string]Hub{"memory": memoryHub, "redis": redisHub}
+}
+
+func TestClaimFeedName(t *testing.T) {
+	ctx := context.Background()
+	for backend, hub := range testHubs(t) {
+		t.Run(backend, func(t *testing.T) {
+			in := newIngester("http://localhost", hub, nil, nil)
+			sid, token, _, err := in.claimFeed(ctx, handshake{name: "demo"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sid != "demo" || token == "" {
+				t.Errorf("claimFeed() = %q, %q, want \"demo\" and a token", sid, token)
+			}
+			// The name stays taken once the first client has started streaming, too
+			pushChunks(t, hub, "demo", "data")
+			for _, hs := range []handshake{{name: "demo"}, {name: "demo", identity: "SHA256:abc"}} {
+				if _, _, _, err := in.claimFeed(ctx, hs); !errors.Is(err, errFeedNameTaken) {
+					t.Errorf("claimFeed(%+v) error = %v, want %v", hs, err, errFeedNameTaken)
+				}
+			}
+			if _, _, _, err := in.claimFeed(ctx, handshake{name: "example"}); !errors.Is(err, errFeedNameTaken) {
+				t.Errorf("claimFeed(example) error = %v, want %v", err, errFeedNameTaken)
+			}
+			sid, _, _, err = in.claimFeed(ctx, handshake{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sid == "" || sid == "demo" {
+				t.Errorf("claimFeed() without a name = %q, want a random feed ID", sid)
+			}
+		})
+	}
+}
+
+func TestClaimFeedReattach(t *testing.T) {
+	ctx := context.Background()
+	for backend, hub := range testHubs(t) {
+		t.Run(backend, func(t *testing.T) {
+			in := newIngester("http://localhost", hub, nil, nil)
+			sid, token, _, err := in.claimFeed(ctx, handshake{name: "demo"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pushChunks(t, hub, sid, "data")
+			tests := []struct {
+				name    string
+				hs      handshake
+				wantErr error
+			}{
+				{name: "correct token", hs: handshake{feed: sid, token: token}},
+				{name: "wrong token", hs: handshake{feed: sid, token: token + "x"}, wantErr: errInvalidOwnerToken},
+				{name: "no token", hs: handshake{feed: sid}, wantErr: errInvalidOwnerToken},
+				{name: "SSH key", hs: handshake{feed: sid, identity: "SHA256:abc"}, wantErr: errInvalidOwnerToken},
+				{name: "unknown feed", hs: handshake{feed: "unknown", token: token}, wantErr: errInvalidOwnerToken},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					got, gotToken, _, err := in.claimFeed(ctx, tt.hs)
+					if !errors.Is(err, tt.wantErr) {
+						t.Fatalf("claimFeed() error = %v, want %v", err, tt.wantErr)
+					}
+					if err == nil && (got != sid || gotToken != "") {
+						t.Errorf("claimFeed() = %q, %q, want %q without a new token", got, gotToken, sid)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestIngestIdleStream(t *testing.T) {
+	ctx := context.Background()
+	hub := NewMemoryHub(1024*1024, time.Hour)
+	defer hub.Close()
+	in := newIngester("http://localhost", hub, nil, NewInMemoryBandwidthLimiter(1024*1024, 1024*1024, 0))
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("data"))
+
+	var notices bytes.Buffer
+	stream := &idleReader{reader: server, setReadDeadline: server.SetReadDeadline, timeout: time.Millisecond * 100}
+	done := make(chan empty)
+	go func() {
+		in.ingest(ctx, make(chan empty), "feed", "192.0.2.1", stream, &notices)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("ingest kept waiting for an idle producer")
+	}
+	if !strings.Contains(notices.String(), "no data received") {
+		t.Errorf("notices = %q, want an idle notice", notices.String())
+	}
+	entries, err := hub.GetEntries(ctx, "feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || string(entries[0].Data) != "data" {
+		t.Errorf("entries = %v, want the data sent before going idle", entries)
+	}
+}
+
+func TestIngestDailyQuotaExceeded(t *testing.T) {
+	ctx := context.Background()
+	hub := NewMemoryHub(1024*1024, time.Hour)
+	defer hub.Close()
+	bandwidth := NewInMemoryBandwidthLimiter(0, 0, 10)
+	defer bandwidth.Stop()
+	in := newIngester("http://localhost", hub, nil, bandwidth)
+	in.bufsize = 5
+
+	var notices bytes.Buffer
+	in.ingest(ctx, make(chan empty), "feed", "192.0.2.1", strings.NewReader("hello world!"), &notices)
+	if want := "only the first 10 bytes you sent were streamed"; !strings.Contains(notices.String(), want) {
+		t.Errorf("notices = %q, want them to contain %q", notices.String(), want)
+	}
+	entries, err := hub.GetEntries(ctx, "feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data string
+	for _, entry := range entries {
+		data += string(entry.Data)
+	}
+	if data != "hello worl" {
+		t.Errorf("feed = %q, want the data sent before the quota was exhausted", data)
+	}
+}
@@ -0,0 +1,357 @@
+package nacre
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Rate limiter rejection reasons.
+const (
+	rejectionClientsPerIP = "clients_per_ip"
+	rejectionPeersPerFeed = "peers_per_feed"
+	rejectionPasswords    = "failed_passwords"
+	rejectionBandwidth    = "bandwidth"
+	rejectionDailyQuota   = "daily_quota"
+)
+
+var (
+	tcpProducersActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nacre",
+		Name:      "tcp_producers_active",
+		Help:      "Number of producers currently streaming data over TCP.",
+	})
+	httpProducersActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nacre",
+		Name:      "http_producers_active",
+		Help:      "Number of producers currently streaming data over HTTP.",
+	})
+	websocketProducersActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nacre",
+		Name:      "websocket_producers_active",
+		Help:      "Number of producers currently publishing data over websockets.",
+	})
+	sshProducersActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nacre",
+		Name:      "ssh_producers_active",
+		Help:      "Number of producers currently streaming data over SSH.",
+	})
+	websocketPeersActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nacre",
+		Name:      "websocket_peers_active",
+		Help:      "Number of websocket peers currently viewing a feed.",
+	})
+	ssePeersActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nacre",
+		Name:      "sse_peers_active",
+		Help:      "Number of server-sent event peers currently viewing a feed.",
+	})
+	bytesIngested = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nacre",
+		Name:      "ingested_bytes_total",
+		Help:      "Number of feed data bytes received from producers.",
+	})
+	bytesServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nacre",
+		Name:      "served_bytes_total",
+		Help:      "Number of feed data bytes sent to viewers, by endpoint.",
+	}, []string{"endpoint"})
+	hubOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nacre",
+		Name:      "hub_operation_duration_seconds",
+		Help:      "Latency of Hub operations, by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"operation"})
+	hubOperationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nacre",
+		Name:      "hub_operation_errors_total",
+		Help:      "Number of failed Hub operations, by operation.",
+	}, []string{"operation"})
+	redisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nacre",
+		Name:      "redis_errors_total",
+		Help:      "Number of failed Redis commands, by command.",
+	}, []string{"command"})
+	rateLimiterRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nacre",
+		Name:      "rate_limiter_rejections_total",
+		Help:      "Number of clients, peers or reads rejected or throttled by rate limiting, by reason.",
+	}, []string{"reason"})
+)
+
+// metricsRegistry holds all of nacre's metrics, along with the Go runtime and process metrics.
+var metricsRegistry = newMetricsRegistry()
+
+func newMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		tcpProducersActive,
+		httpProducersActive,
+		websocketProducersActive,
+		sshProducersActive,
+		websocketPeersActive,
+		ssePeersActive,
+		bytesIngested,
+		bytesServed,
+		hubOperationDuration,
+		hubOperationErrors,
+		redisErrors,
+		rateLimiterRejections,
+	)
+	return registry
+}
+
+// observeHubOperation records the latency and outcome of a Hub operation started at 'start'.
+func observeHubOperation(operation string, start time.Time, err error) {
+	hubOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		hubOperationErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// observeServedEntries records the feed data bytes of entries sent to viewers.
+func observeServedEntries(endpoint string, entries ...Entry) {
+	served := 0
+	for _, entry := range entries {
+		served += len(entry.Data)
+	}
+	bytesServed.WithLabelValues(endpoint).Add(float64(served))
+}
+
+// instrumentedHub is a Hub decorator which records the latency and errors of every operation.
+type instrumentedHub struct {
+	inner Hub
+}
+
+var _ Hub = (*instrumentedHub)(nil)
+
+// NewInstrumentedHub wraps the hub so that its operations are exposed as metrics.
+func NewInstrumentedHub(hub Hub) Hub {
+	return &instrumentedHub{inner: hub}
+}
+
+func (hub *instrumentedHub) FeedExists(ctx context.Context, id string) (bool, error) {
+	start := time.Now()
+	exists, err := hub.inner.FeedExists(ctx, id)
+	observeHubOperation("feed_exists", start, err)
+	return exists, err
+}
+
+func (hub *instrumentedHub) ReserveFeed(ctx context.Context, id string, owner string) (bool, error) {
+	start := time.Now()
+	ok, err := hub.inner.ReserveFeed(ctx, id, owner)
+	observeHubOperation("reserve_feed", start, err)
+	return ok, err
+}
+
+func (hub *instrumentedHub) FeedOwner(ctx context.Context, id string) (string, error) {
+	start := time.Now()
+	owner, err := hub.inner.FeedOwner(ctx, id)
+	observeHubOperation("feed_owner", start, err)
+	return owner, err
+}
+
+func (hub *instrumentedHub) SetFeedSecret(ctx context.Context, id string, secret string) error {
+	start := time.Now()
+	err := hub.inner.SetFeedSecret(ctx, id, secret)
+	observeHubOperation("set_feed_secret", start, err)
+	return err
+}
+
+func (hub *instrumentedHub) FeedSecret(ctx context.Context, id string) (string, error) {
+	start := time.Now()
+	secret, err := hub.inner.FeedSecret(ctx, id)
+	observeHubOperation("feed_secret", start, err)
+	return secret, err
+}
+
+func (hub *instrumentedHub) Push(ctx context.Context, id string, data []byte) error {
+	start := time.Now()
+	err := hub.inner.Push(ctx, id, data)
+	observeHubOperation("push", start, err)
+	if err == nil {
+		bytesIngested.Add(float64(len(data)))
+	}
+	return err
+}
+
+func (hub *instrumentedHub) Listen(ctx context.Context, id string, lastID string) (<-chan Entry, error) {
+	start := time.Now()
+	ch, err := hub.inner.Listen(ctx, id, lastID)
+	observeHubOperation("listen", start, err)
+	return ch, err
+}
+
+func (hub *instrumentedHub) GetAll(ctx context.Context, id string) ([][]byte, error) {
+	start := time.Now()
+	data, err := hub.inner.GetAll(ctx, id)
+	observeHubOperation("get_all", start, err)
+	return data, err
+}
+
+func (hub *instrumentedHub) GetEntries(ctx context.Context, id string) ([]Entry, error) {
+	start := time.Now()
+	entries, err := hub.inner.GetEntries(ctx, id)
+	observeHubOperation("get_entries", start, err)
+	return entries, err
+}
+
+func (hub *instrumentedHub) GetEntriesAfter(ctx context.Context, id string, afterID string, limit int) ([]Entry, error) {
+	start := time.Now()
+	entries, err := hub.inner.GetEntriesAfter(ctx, id, afterID, limit)
+	if errors.Is(err, errInvalidEntryID) {
+		// Invalid input rather than a failure of the hub
+		observeHubOperation("get_entries_after", start, nil)
+	} else {
+		observeHubOperation("get_entries_after", start, err)
+	}
+	return entries, err
+}
+
+func (hub *instrumentedHub) FeedInfo(ctx context.Context, id string) (FeedInfo, error) {
+	start := time.Now()
+	info, err := hub.inner.FeedInfo(ctx, id)
+	observeHubOperation("feed_info", start, err)
+	return info, err
+}
+
+func (hub *instrumentedHub) ClientState(ctx context.Context, id string) (ClientState, error) {
+	start := time.Now()
+	state, err := hub.inner.ClientState(ctx, id)
+	observeHubOperation("client_state", start, err)
+	return state, err
+}
+
+func (hub *instrumentedHub) ClientConnected(ctx context.Context, id string) error {
+	start := time.Now()
+	err := hub.inner.ClientConnected(ctx, id)
+	observeHubOperation("client_connected", start, err)
+	return err
+}
+
+func (hub *instrumentedHub) ClientDisconnected(ctx context.Context, id string) error {
+	start := time.Now()
+	err := hub.inner.ClientDisconnected(ctx, id)
+	observeHubOperation("client_disconnected", start, err)
+	return err
+}
+
+func (hub *instrumentedHub) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := hub.inner.Ping(ctx)
+	observeHubOperation("ping", start, err)
+	return err
+}
+
+func (hub *instrumentedHub) Close() error {
+	return hub.inner.Close()
+}
+
+// instrumentedRateLimiter is a RateLimiter decorator which counts rejected clients and peers.
+type instrumentedRateLimiter struct {
+	RateLimiter
+}
+
+var _ RateLimiter = (*instrumentedRateLimiter)(nil)
+
+// NewInstrumentedRateLimiter wraps the rate limiter so that its rejections are exposed as metrics.
+func NewInstrumentedRateLimiter(rateLimiter RateLimiter) RateLimiter {
+	return &instrumentedRateLimiter{RateLimiter: rateLimiter}
+}
+
+func (r *instrumentedRateLimiter) TryAddClient(ctx context.Context, ip string) bool {
+	ok := r.RateLimiter.TryAddClient(ctx, ip)
+	if !ok {
+		rateLimiterRejections.WithLabelValues(rejectionClientsPerIP).Inc()
+	}
+	return ok
+}
+
+func (r *instrumentedRateLimiter) TryAddPeer(ctx context.Context, id string) bool {
+	ok := r.RateLimiter.TryAddPeer(ctx, id)
+	if !ok {
+		rateLimiterRejections.WithLabelValues(rejectionPeersPerFeed).Inc()
+	}
+	return ok
+}
+
+func (r *instrumentedRateLimiter) AllowPasswordAttempt(ctx context.Context, ip string, id string) bool {
+	ok := r.RateLimiter.AllowPasswordAttempt(ctx, ip, id)
+	if !ok {
+		rateLimiterRejections.WithLabelValues(rejectionPasswords).Inc()
+	}
+	return ok
+}
+
+// instrumentedBandwidthLimiter is a BandwidthLimiter decorator which counts throttled
+// reads and exhausted quotas.
+type instrumentedBandwidthLimiter struct {
+	BandwidthLimiter
+}
+
+var _ BandwidthLimiter = (*instrumentedBandwidthLimiter)(nil)
+
+// NewInstrumentedBandwidthLimiter wraps the bandwidth limiter so that its rejections
+// are exposed as metrics.
+func NewInstrumentedBandwidthLimiter(bandwidth BandwidthLimiter) BandwidthLimiter {
+	return &instrumentedBandwidthLimiter{BandwidthLimiter: bandwidth}
+}
+
+func (b *instrumentedBandwidthLimiter) Reserve(ip string, n int) (time.Duration, error) {
+	delay, err := b.BandwidthLimiter.Reserve(ip, n)
+	if errors.Is(err, errDailyQuotaExceeded) {
+		rateLimiterRejections.WithLabelValues(rejectionDailyQuota).Inc()
+	} else if delay > 0 {
+		rateLimiterRejections.WithLabelValues(rejectionBandwidth).Inc()
+	}
+	return delay, err
+}
+
+// redisMetricsHook is a redis.Hook which counts failed Redis commands.
+type redisMetricsHook struct{}
+
+var _ redis.Hook = redisMetricsHook{}
+
+func (redisMetricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (redisMetricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		observeRedisCommand(cmd)
+		return err
+	}
+}
+
+func (redisMetricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		for _, cmd := range cmds {
+			observeRedisCommand(cmd)
+		}
+		return err
+	}
+}
+
+func observeRedisCommand(cmd redis.Cmder) {
+	err := cmd.Err()
+	switch {
+	case err == nil:
+	case err == redis.Nil:
+		// Missing keys or timed out blocking reads are not failures
+	case errors.Is(err, context.Canceled):
+		// Cancelled by the caller, e.g. a viewer going away
+	case strings.HasPrefix(err.Error(), "NOSCRIPT"):
+		// Scripts are loaded on demand after their EVALSHA fails
+	default:
+		redisErrors.WithLabelValues(cmd.Name()).Inc()
+	}
+}
@@ -1,6 +1,9 @@
 package nacre
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -9,39 +12,178 @@ import (
 	"time"
 
 	"github.com/go-redis/redis/v9"
+	"golang.org/x/sync/errgroup"
 )
 
 // Root is the root struct defining the nacre server dependencies.
 type Root struct {
 	Cfg Config
 
-	Hub  Hub
-	HTTP *HTTPServer
-	TCP  *TCPServer
+	Hub         Hub
+	RateLimiter RateLimiter
+	Bandwidth   BandwidthLimiter
+	HTTP        *HTTPServer
+	TCP         *TCPServer   // Plain TCP server, or nil if disabled
+	TLS         *TCPServer   // TLS-encrypted TCP server, or nil if disabled
+	SSH         *SSHServer   // SSH server, or nil if disabled
+	Admin       *AdminServer // Operational endpoints server, or nil if disabled
 }
 
 // DefaultServer returns a Root nacre instance with the default configuration and setup.
 func DefaultServer(cfg Config) (Root, error) {
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     net.JoinHostPort(cfg.Redis.Host, cfg.Redis.Port),
-		Password: cfg.Redis.Password,
-		DB:       0,
-	})
-	hub := NewRedisHub(redisClient, cfg.App.MaxRedisStreamLen, cfg.App.MaxStreamPersistence)
-	rateLimiter := NewInMemoryRateLimiter()
-	tcpServer, err := NewTCPServer(cfg.App.TCPAddr, cfg.App.BaseURL, hub, rateLimiter)
-	if err != nil {
-		return Root{}, err
+	var redisClient *redis.Client
+	if cfg.App.HubBackend == HubBackendRedis || cfg.App.RateLimiterBackend == RateLimiterBackendRedis {
+		redisClient = redis.NewClient(&redis.Options{
+			Addr:     net.JoinHostPort(cfg.Redis.Host, cfg.Redis.Port),
+			Password: cfg.Redis.Password,
+			DB:       0,
+		})
+		redisClient.AddHook(redisMetricsHook{})
+	}
+	var hub Hub
+	switch cfg.App.HubBackend {
+	case HubBackendRedis:
+		hub = NewRedisHub(redisClient, cfg.App.MaxStreamBytes, cfg.App.MaxStreamPersistence)
+	case HubBackendMemory:
+		hub = NewMemoryHub(cfg.App.MaxStreamBytes, cfg.App.MaxStreamPersistence)
+	default:
+		return Root{}, fmt.Errorf("unsupported hub backend %q", cfg.App.HubBackend)
+	}
+	hub = NewInstrumentedHub(hub)
+	var rateLimiter RateLimiter
+	switch cfg.App.RateLimiterBackend {
+	case RateLimiterBackendRedis:
+		rateLimiter = NewRedisRateLimiter(redisClient)
+	case RateLimiterBackendMemory:
+		rateLimiter = NewInMemoryRateLimiter()
+	default:
+		return Root{}, fmt.Errorf("unsupported rate limiter backend %q", cfg.App.RateLimiterBackend)
+	}
+	rateLimiter = NewInstrumentedRateLimiter(rateLimiter)
+	bandwidth := NewInstrumentedBandwidthLimiter(
+		NewInMemoryBandwidthLimiter(cfg.App.BandwidthLimit, cfg.App.BandwidthBurst, cfg.App.DailyQuota),
+	)
+	var tcpServer, tlsServer *TCPServer
+	if cfg.App.TCPAddr != "" {
+		server, err := NewTCPServer(cfg.App.TCPAddr, cfg.App.ProxyProtocolTrusted, cfg.App.BaseURL, hub, rateLimiter, bandwidth)
+		if err != nil {
+			return Root{}, err
+		}
+		tcpServer = server
+	}
+	if cfg.TLS.Addr != "" {
+		tlsConfig, err := loadTLSConfig(cfg.TLS)
+		if err != nil {
+			return Root{}, err
+		}
+		server, err := NewTLSServer(cfg.TLS.Addr, tlsConfig, cfg.App.ProxyProtocolTrusted, cfg.App.BaseURL, hub, rateLimiter, bandwidth)
+		if err != nil {
+			return Root{}, err
+		}
+		tlsServer = server
+	}
+	var sshServer *SSHServer
+	if cfg.SSH.Addr != "" {
+		server, err := NewSSHServer(cfg.SSH.Addr, cfg.SSH.HostKeyFile, cfg.App.ProxyProtocolTrusted, cfg.App.BaseURL, hub, rateLimiter, bandwidth)
+		if err != nil {
+			return Root{}, err
+		}
+		sshServer = server
+	}
+	httpServer := NewHTTPServer(cfg.App.HTTPAddr, cfg.App.TrustedProxies, cfg.App.BaseURL, hub, rateLimiter, bandwidth)
+	var adminServer *AdminServer
+	if cfg.App.AdminAddr != "" {
+		listeners := make(map[string]ingestionListener)
+		if tcpServer != nil {
+			listeners["tcp"] = tcpServer
+		}
+		if tlsServer != nil {
+			listeners["tls"] = tlsServer
+		}
+		if sshServer != nil {
+			listeners["ssh"] = sshServer
+		}
+		adminServer = NewAdminServer(cfg.App.AdminAddr, hub, listeners)
 	}
-	httpServer := NewHTTPServer(cfg.App.HTTPAddr, hub, rateLimiter)
 	return Root{
-		Cfg:  cfg,
-		Hub:  hub,
-		HTTP: httpServer,
-		TCP:  tcpServer,
+		Cfg:         cfg,
+		Hub:         hub,
+		RateLimiter: rateLimiter,
+		Bandwidth:   bandwidth,
+		HTTP:        httpServer,
+		TCP:         tcpServer,
+		TLS:         tlsServer,
+		SSH:         sshServer,
+		Admin:       adminServer,
 	}, nil
 }
 
+// Shutdown gracefully stops all servers, waiting for their connections to drain until
+// the context is done, and then releases the rate limiter and hub. If the admin server
+// is enabled, readiness checks fail for the drain grace period before the servers stop.
+func (root Root) Shutdown(ctx context.Context) error {
+	if root.Admin != nil {
+		// Fail readiness checks so that no new traffic is routed to this instance, and keep
+		// accepting connections until load balancers have noticed
+		root.Admin.Drain()
+		select {
+		case <-time.After(root.Cfg.App.DrainGracePeriod):
+		case <-ctx.Done():
+		}
+	}
+	group := new(errgroup.Group)
+	for _, server := range []*TCPServer{root.TCP, root.TLS} {
+		if server == nil {
+			continue
+		}
+		server := server
+		group.Go(func() error { return server.Shutdown(ctx) })
+	}
+	if root.SSH != nil {
+		group.Go(func() error { return root.SSH.Shutdown(ctx) })
+	}
+	group.Go(func() error { return root.HTTP.Shutdown(ctx) })
+	err := group.Wait()
+	if root.Admin != nil {
+		// Keep operational endpoints available for as long as connections are draining
+		if adminErr := root.Admin.Shutdown(ctx); err == nil {
+			err = adminErr
+		}
+	}
+	root.RateLimiter.Stop()
+	root.Bandwidth.Stop()
+	if closeErr := root.Hub.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// loadTLSConfig loads the server certificate and, if configured, the CA certificates
+// used to verify client certificates.
+func loadTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates in TLS client CA file %s", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
 // RedisConfig exposes Redis-specific configuration options.
 type RedisConfig struct {
 	Host     string
@@ -49,18 +191,56 @@ type RedisConfig struct {
 	Password string
 }
 
+// TLSConfig exposes configuration options for TLS-encrypted data streams.
+type TLSConfig struct {
+	Addr         string // Address of the TLS listener, or empty to disable it
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string // CA certificates for verifying clients, or empty to not require client certificates
+}
+
+// SSHConfig exposes configuration options for the SSH server.
+type SSHConfig struct {
+	Addr        string // Address of the SSH listener, or empty to disable it
+	HostKeyFile string // Private key identifying the server to SSH clients
+}
+
+// Supported Hub backends.
+const (
+	HubBackendRedis  = "redis"
+	HubBackendMemory = "memory"
+)
+
+// Supported RateLimiter backends.
+const (
+	RateLimiterBackendRedis  = "redis"
+	RateLimiterBackendMemory = "memory"
+)
+
 // AppConfig exposes Nacre-specific configuration options.
 type AppConfig struct {
 	TCPAddr              string
+	ProxyProtocolTrusted CIDRs // Proxies which send PROXY protocol headers to the TCP, TLS and SSH listeners
 	HTTPAddr             string
+	TrustedProxies       CIDRs  // Proxies whose Forwarded and X-Forwarded-For headers are trusted by the HTTP server
+	AdminAddr            string // Address of the operational endpoints server, or empty to disable it
 	BaseURL              string
-	MaxRedisStreamLen    int
+	HubBackend           string
+	RateLimiterBackend   string
+	MaxStreamBytes       int64 // Maximum # of bytes stored per feed before evicting its oldest data
 	MaxStreamPersistence time.Duration
+	ShutdownTimeout      time.Duration // Maximum time for draining connections on shutdown
+	DrainGracePeriod     time.Duration // Time between failing readiness checks and closing the listeners on shutdown
+	BandwidthLimit       int           // Bytes per second ingested per IP, or 0 for no limit
+	BandwidthBurst       int           // Bytes ingested per IP in bursts exceeding the limit
+	DailyQuota           int64         // Bytes ingested per IP per day, or 0 for no quota
 }
 
 // Config is the root structure containing Nacre configuration.
 type Config struct {
 	Redis RedisConfig
+	TLS   TLSConfig
+	SSH   SSHConfig
 	App   AppConfig
 }
 
@@ -76,26 +256,69 @@ func ParseConfig() (Config, error) {
 		App: AppConfig{
 			TCPAddr:              ":1337",
 			HTTPAddr:             ":8080",
+			AdminAddr:            "127.0.0.1:8081",
 			BaseURL:              "http://localhost:8080",
-			MaxRedisStreamLen:    1_000,
+			HubBackend:           HubBackendRedis,
+			RateLimiterBackend:   RateLimiterBackendMemory,
+			MaxStreamBytes:       1024 * 1024,
 			MaxStreamPersistence: time.Hour * 24,
+			ShutdownTimeout:      time.Second * 15,
+			DrainGracePeriod:     time.Second * 5,
+			BandwidthLimit:       64 * 1024,
+			BandwidthBurst:       1024 * 1024,
+			DailyQuota:           256 * 1024 * 1024,
 		},
 	}
-	if v := os.Getenv("NACRE_TCP_ADDR"); v != "" {
+	if v, ok := os.LookupEnv("NACRE_TCP_ADDR"); ok {
+		// An explicitly empty address disables the plain TCP listener
 		cfg.App.TCPAddr = v
 	}
+	if v := os.Getenv("NACRE_PROXY_PROTOCOL_TRUSTED"); v != "" {
+		cidrs, err := ParseCIDRs(v)
+		if err != nil {
+			return cfg, fmt.Errorf("NACRE_PROXY_PROTOCOL_TRUSTED invalid: %w", err)
+		}
+		cfg.App.ProxyProtocolTrusted = cidrs
+	}
 	if v := os.Getenv("NACRE_HTTP_ADDR"); v != "" {
 		cfg.App.HTTPAddr = v
 	}
+	if v := os.Getenv("NACRE_TRUSTED_PROXIES"); v != "" {
+		cidrs, err := ParseCIDRs(v)
+		if err != nil {
+			return cfg, fmt.Errorf("NACRE_TRUSTED_PROXIES invalid: %w", err)
+		}
+		cfg.App.TrustedProxies = cidrs
+	}
+	if v, ok := os.LookupEnv("NACRE_ADMIN_ADDR"); ok {
+		// An explicitly empty address disables the admin server
+		cfg.App.AdminAddr = v
+	}
 	if v := os.Getenv("NACRE_BASE_URL"); v != "" {
 		cfg.App.BaseURL = v
 	}
-	if v := os.Getenv("NACRE_MAX_STREAM_LEN"); v != "" {
-		maxLen, err := strconv.Atoi(v)
-		if err != nil {
-			return cfg, fmt.Errorf("NACRE_MAX_STREAM_LEN invalid: %w", err)
+	if v := os.Getenv("NACRE_HUB_BACKEND"); v != "" {
+		if v != HubBackendRedis && v != HubBackendMemory {
+			return cfg, fmt.Errorf("NACRE_HUB_BACKEND invalid: %q", v)
+		}
+		cfg.App.HubBackend = v
+	}
+	if v := os.Getenv("NACRE_RATE_LIMITER"); v != "" {
+		if v != RateLimiterBackendRedis && v != RateLimiterBackendMemory {
+			return cfg, fmt.Errorf("NACRE_RATE_LIMITER invalid: %q", v)
 		}
-		cfg.App.MaxRedisStreamLen = maxLen
+		cfg.App.RateLimiterBackend = v
+	}
+	if os.Getenv("NACRE_MAX_STREAM_LEN") != "" {
+		// Silently ignoring the old entry-based limit would change how much of each feed is kept
+		return cfg, fmt.Errorf("NACRE_MAX_STREAM_LEN is no longer supported, use NACRE_MAX_STREAM_BYTES instead")
+	}
+	if v := os.Getenv("NACRE_MAX_STREAM_BYTES"); v != "" {
+		maxBytes, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || maxBytes <= 0 {
+			return cfg, fmt.Errorf("NACRE_MAX_STREAM_BYTES invalid: %q", v)
+		}
+		cfg.App.MaxStreamBytes = maxBytes
 	}
 	if v := os.Getenv("NACRE_MAX_STREAM_PERSISTENCE"); v != "" {
 		persistDur, err := time.ParseDuration(v)
@@ -104,6 +327,68 @@ func ParseConfig() (Config, error) {
 		}
 		cfg.App.MaxStreamPersistence = persistDur
 	}
+	if v := os.Getenv("NACRE_SHUTDOWN_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, fmt.Errorf("NACRE_SHUTDOWN_TIMEOUT invalid: %w", err)
+		}
+		cfg.App.ShutdownTimeout = timeout
+	}
+	if v := os.Getenv("NACRE_DRAIN_GRACE_PERIOD"); v != "" {
+		period, err := time.ParseDuration(v)
+		if err != nil || period < 0 {
+			return cfg, fmt.Errorf("NACRE_DRAIN_GRACE_PERIOD invalid: %q", v)
+		}
+		cfg.App.DrainGracePeriod = period
+	}
+	if v := os.Getenv("NACRE_BANDWIDTH_LIMIT"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return cfg, fmt.Errorf("NACRE_BANDWIDTH_LIMIT invalid: %q", v)
+		}
+		cfg.App.BandwidthLimit = limit
+	}
+	if v := os.Getenv("NACRE_BANDWIDTH_BURST"); v != "" {
+		burst, err := strconv.Atoi(v)
+		if err != nil || burst <= 0 {
+			return cfg, fmt.Errorf("NACRE_BANDWIDTH_BURST invalid: %q", v)
+		}
+		cfg.App.BandwidthBurst = burst
+	}
+	if v := os.Getenv("NACRE_DAILY_QUOTA"); v != "" {
+		quota, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || quota < 0 {
+			return cfg, fmt.Errorf("NACRE_DAILY_QUOTA invalid: %q", v)
+		}
+		cfg.App.DailyQuota = quota
+	}
+	if v := os.Getenv("NACRE_TLS_ADDR"); v != "" {
+		cfg.TLS.Addr = v
+	}
+	if v := os.Getenv("NACRE_TLS_CERT_FILE"); v != "" {
+		cfg.TLS.CertFile = v
+	}
+	if v := os.Getenv("NACRE_TLS_KEY_FILE"); v != "" {
+		cfg.TLS.KeyFile = v
+	}
+	if v := os.Getenv("NACRE_TLS_CLIENT_CA_FILE"); v != "" {
+		cfg.TLS.ClientCAFile = v
+	}
+	if cfg.TLS.Addr != "" && (cfg.TLS.CertFile == "" || cfg.TLS.KeyFile == "") {
+		return cfg, fmt.Errorf("NACRE_TLS_ADDR requires NACRE_TLS_CERT_FILE and NACRE_TLS_KEY_FILE")
+	}
+	if v := os.Getenv("NACRE_SSH_ADDR"); v != "" {
+		cfg.SSH.Addr = v
+	}
+	if v := os.Getenv("NACRE_SSH_HOST_KEY_FILE"); v != "" {
+		cfg.SSH.HostKeyFile = v
+	}
+	if cfg.SSH.Addr != "" && cfg.SSH.HostKeyFile == "" {
+		return cfg, fmt.Errorf("NACRE_SSH_ADDR requires NACRE_SSH_HOST_KEY_FILE")
+	}
+	if cfg.App.TCPAddr == "" && cfg.TLS.Addr == "" && cfg.SSH.Addr == "" {
+		return cfg, fmt.Errorf("at least one of NACRE_TCP_ADDR, NACRE_TLS_ADDR and NACRE_SSH_ADDR must be set")
+	}
 	if v := os.Getenv("NACRE_REDIS_HOST"); v != "" {
 		cfg.Redis.Host = v
 	}
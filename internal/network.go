@@ -0,0 +1,66 @@
+package nacre
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// CIDRs is a list of IP networks, such as the addresses of trusted proxies.
+type CIDRs []*net.IPNet
+
+// ParseCIDRs parses a comma-separated list of CIDR blocks. Single IP addresses
+// are accepted as networks containing just that address.
+func ParseCIDRs(list string) (CIDRs, error) {
+	var cidrs CIDRs
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR block %q", v)
+		}
+		cidrs = append(cidrs, network)
+	}
+	return cidrs, nil
+}
+
+// Contains returns true if any of the networks contains the IP.
+func (c CIDRs) Contains(ip net.IP) bool {
+	for _, network := range c {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAddr returns true if any of the networks contains the address's IP.
+func (c CIDRs) ContainsAddr(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && c.Contains(tcpAddr.IP)
+}
+
+// MarshalJSON represents the networks in CIDR notation.
+func (c CIDRs) MarshalJSON() ([]byte, error) {
+	blocks := make([]string, 0, len(c))
+	for _, network := range c {
+		blocks = append(blocks, network.String())
+	}
+	return json.Marshal(blocks)
+}
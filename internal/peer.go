@@ -2,10 +2,13 @@ package nacre
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"net"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/johanmickos/nacre/internal/ws"
 )
 
 const (
@@ -21,6 +24,10 @@ const (
 type Peer struct {
 	conn *websocket.Conn
 	hub  Hub
+	quit <-chan empty // Closed when the server shuts down
+
+	// controls receives replay controls sent by the peer, if replaying.
+	controls chan replayControl
 }
 
 func (peer *Peer) readLoop(ctx context.Context) error {
@@ -37,7 +44,7 @@ func (peer *Peer) readLoop(ctx context.Context) error {
 			return nil
 		default: // OK
 		}
-		_, _, err := peer.conn.ReadMessage()
+		msgType, msg, err := peer.conn.ReadMessage()
 		if err != nil {
 			if errors.Is(err, websocket.ErrCloseSent) {
 				return nil
@@ -52,12 +59,24 @@ func (peer *Peer) readLoop(ctx context.Context) error {
 			}
 			return nil
 		}
+		if peer.controls == nil || msgType != websocket.TextMessage {
+			continue
+		}
+		var control replayControl
+		if err := json.Unmarshal(msg, &control); err != nil {
+			continue
+		}
+		select {
+		case peer.controls <- control: // OK
+		case <-ctx.Done():
+			return nil
+		}
 	}
 }
 
-// writeLoop pushes feed data to the connected peer.
-func (peer *Peer) writeLoop(ctx context.Context, id string) error {
-	data, err := peer.hub.Listen(ctx, id)
+// writeLoop pushes feed entries following lastID to the connected peer.
+func (peer *Peer) writeLoop(ctx context.Context, id string, lastID string) error {
+	entries, err := peer.hub.Listen(ctx, id, lastID)
 	if err != nil {
 		return err
 	}
@@ -65,11 +84,10 @@ func (peer *Peer) writeLoop(ctx context.Context, id string) error {
 	for {
 		select {
 		case <-ctx.Done():
-			return peer.conn.WriteMessage(
-				websocket.CloseMessage,
-				websocket.FormatCloseMessage(websocket.CloseGoingAway, "Request context completed"),
-			)
-		case message, ok := <-data:
+			return peer.closeContextDone()
+		case <-peer.quit:
+			return peer.closeShutdown()
+		case entry, ok := <-entries:
 			peer.conn.SetWriteDeadline(time.Now().Add(writeDeadline))
 			if !ok {
 				_ = peer.conn.WriteMessage(
@@ -78,12 +96,13 @@ func (peer *Peer) writeLoop(ctx context.Context, id string) error {
 				)
 				return nil
 			}
-			if err := peer.conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+			if err := peer.conn.WriteMessage(websocket.BinaryMessage, encodeEntry(entry)); err != nil {
 				if errors.Is(err, websocket.ErrCloseSent) {
 					return nil
 				}
 				return err
 			}
+			observeServedEntries("websocket", entry)
 		case <-ticker.C:
 			peer.conn.SetWriteDeadline(time.Now().Add(writeDeadline))
 			if err := peer.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -95,3 +114,41 @@ func (peer *Peer) writeLoop(ctx context.Context, id string) error {
 		}
 	}
 }
+
+// closeContextDone tells the peer that its request has completed. The request also completes
+// when the read loop returns because the peer closed the connection, after which the
+// close message can no longer be sent.
+func (peer *Peer) closeContextDone() error {
+	peer.conn.SetWriteDeadline(time.Now().Add(writeDeadline))
+	err := peer.conn.WriteMessage(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, "Request context completed"),
+	)
+	if errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// closeShutdown tells the peer that the server is going away,
+// leaving it free to reconnect to another instance.
+func (peer *Peer) closeShutdown() error {
+	peer.conn.SetWriteDeadline(time.Now().Add(writeDeadline))
+	err := peer.conn.WriteMessage(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server shutting down"),
+	)
+	if errors.Is(err, websocket.ErrCloseSent) {
+		return nil
+	}
+	return err
+}
+
+// encodeEntry frames the entry as a binary websocket message,
+// replacing truncated entries with a notice for the peer.
+func encodeEntry(entry Entry) []byte {
+	if entry.Truncated {
+		return ws.EncodeEntry("", []byte(truncationNotice))
+	}
+	return ws.EncodeEntry(entry.ID, entry.Data)
+}
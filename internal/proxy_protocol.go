@@ -0,0 +1,157 @@
+package nacre
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Load balancers like nginx can prepend a PROXY protocol header to the connections they
+// proxy, carrying the address of the actual client:
+//
+//	https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+//
+// Both the human-readable version 1 and the binary version 2 of the header are supported.
+const (
+	proxyProtocolTimeout = time.Second * 5
+
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLength = 107
+
+	proxyV2HeaderLength = 16
+	proxyV2CmdLocal     = 0x0
+	proxyV2CmdProxy     = 0x1
+	proxyV2FamilyInet   = 0x1
+	proxyV2FamilyInet6  = 0x2
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxiedConn is a connection whose remote address was read from its PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+	reader     *bufio.Reader // Holds any data which was read along with the header
+	remoteAddr net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// readProxyHeader reads the connection's PROXY protocol header, returning a connection
+// which reports the client address from the header as its remote address.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	prefix, err := reader.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %w", err)
+	}
+	var addr net.Addr
+	switch {
+	case string(prefix) == proxyV1Prefix:
+		addr, err = readProxyV1Header(reader)
+	case bytes.HasPrefix(proxyV2Signature, prefix):
+		addr, err = readProxyV2Header(reader)
+	default:
+		return nil, errors.New("missing PROXY header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		// The header's source is unknown, e.g. for the proxy's own health checks
+		addr = conn.RemoteAddr()
+	}
+	return &proxiedConn{Conn: conn, reader: reader, remoteAddr: addr}, nil
+}
+
+// readProxyV1Header reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1337\r\n".
+func readProxyV1Header(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("invalid PROXY header: line too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid PROXY header: missing CRLF")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY header source %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2Header reads a binary header, skipping any TLVs which follow the addresses.
+func readProxyV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLength)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %w", err)
+	}
+	if !bytes.Equal(header[:len(proxyV2Signature)], proxyV2Signature) {
+		return nil, errors.New("invalid PROXY header signature")
+	}
+	version, command := header[12]>>4, header[12]&0xF
+	family := header[13] >> 4
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported PROXY header version %d", version)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %w", err)
+	}
+
+	switch command {
+	case proxyV2CmdLocal:
+		return nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY header command %d", command)
+	}
+	switch family {
+	case proxyV2FamilyInet:
+		if len(payload) < 12 {
+			return nil, errors.New("invalid PROXY header: truncated IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case proxyV2FamilyInet6:
+		if len(payload) < 36 {
+			return nil, errors.New("invalid PROXY header: truncated IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		// Unix sockets and unspecified families carry no usable client IP
+		return nil, nil
+	}
+}
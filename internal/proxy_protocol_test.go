@@ -0,0 +1,124 @@
+package nacre
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header builds a version 2 header with the provided command byte, family byte and payload.
+func proxyV2Header(command byte, family byte, payload []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyV1Header(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string // Expected remote address, or empty if the header carries none
+		wantErr bool
+	}{
+		{name: "TCP4", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1337\r\n", want: "192.0.2.1:56324"},
+		{name: "TCP6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 1337\r\n", want: "[2001:db8::1]:56324"},
+		{name: "unknown source", input: "PROXY UNKNOWN\r\n", want: ""},
+		{name: "unknown source with addresses", input: "PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 1337\r\n", want: ""},
+		{name: "missing CR", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1337\n", wantErr: true},
+		{name: "missing fields", input: "PROXY TCP4 192.0.2.1 56324\r\n", wantErr: true},
+		{name: "unsupported protocol", input: "PROXY UDP4 192.0.2.1 198.51.100.1 56324 1337\r\n", wantErr: true},
+		{name: "invalid IP", input: "PROXY TCP4 192.0.2 198.51.100.1 56324 1337\r\n", wantErr: true},
+		{name: "invalid port", input: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 1337\r\n", wantErr: true},
+		{name: "line too long", input: "PROXY TCP4 " + strings.Repeat(" ", proxyV1MaxLength) + "\r\n", wantErr: true},
+		{name: "truncated", input: "PROXY TCP4 192.0.2.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.input + "payload"))
+			addr, err := readProxyV1Header(reader)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got address %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertProxyAddr(t, addr, tt.want)
+			assertRemainder(t, reader, "payload")
+		})
+	}
+}
+
+func TestReadProxyV2Header(t *testing.T) {
+	inet := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xDC, 0x04, 0x05, 0x39}
+	inet6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xDC, 0x04, 0x05, 0x39)
+	tlv := []byte{0x04, 0x00, 0x02, 0xAB, 0xCD}
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    string // Expected remote address, or empty if the header carries none
+		wantErr bool
+	}{
+		{name: "IPv4", input: proxyV2Header(0x21, 0x11, inet), want: "192.0.2.1:56324"},
+		{name: "IPv6", input: proxyV2Header(0x21, 0x21, inet6), want: "[2001:db8::1]:56324"},
+		{name: "IPv4 with TLVs", input: proxyV2Header(0x21, 0x11, append(append([]byte(nil), inet...), tlv...)), want: "192.0.2.1:56324"},
+		{name: "local command", input: proxyV2Header(0x20, 0x00, nil), want: ""},
+		{name: "unix socket", input: proxyV2Header(0x21, 0x31, make([]byte, 216)), want: ""},
+		{name: "unsupported version", input: proxyV2Header(0x11, 0x11, inet), wantErr: true},
+		{name: "unsupported command", input: proxyV2Header(0x22, 0x11, inet), wantErr: true},
+		{name: "truncated IPv4 addresses", input: proxyV2Header(0x21, 0x11, inet[:8]), wantErr: true},
+		{name: "truncated IPv6 addresses", input: proxyV2Header(0x21, 0x21, inet6[:32]), wantErr: true},
+		{name: "truncated payload", input: proxyV2Header(0x21, 0x11, inet)[:proxyV2HeaderLength+4], wantErr: true},
+		{name: "invalid signature", input: append([]byte("\r\n\r\n\x00\r\nQUIZ\n"), 0x21, 0x11, 0x00, 0x00), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(io.MultiReader(bytes.NewReader(tt.input), strings.NewReader("payload")))
+			addr, err := readProxyV2Header(reader)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got address %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertProxyAddr(t, addr, tt.want)
+			assertRemainder(t, reader, "payload")
+		})
+	}
+}
+
+func assertProxyAddr(t *testing.T, addr net.Addr, want string) {
+	t.Helper()
+	if want == "" {
+		if addr != nil {
+			t.Errorf("got address %v, want none", addr)
+		}
+		return
+	}
+	if addr == nil || addr.String() != want {
+		t.Errorf("got address %v, want %s", addr, want)
+	}
+}
+
+// assertRemainder checks that the data following the header was left unread.
+func assertRemainder(t *testing.T, reader io.Reader, want string) {
+	t.Helper()
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != want {
+		t.Errorf("data after header is %q, want %q", rest, want)
+	}
+}
@@ -6,19 +6,29 @@ import (
 	"time"
 )
 
-// Nacre natively supports two in-memory rate limiting strategies:
-// - # of concurrent TCP connections by IP
+// Nacre natively supports three rate limiting strategies:
+// - # of concurrent TCP connections by IP, and of SSH feeds by key fingerprint
 // - # of concurrent websocket sessions by feed ID
+// - # of incorrect feed passwords by IP and by feed ID, within a fixed window
 //
-// If horiziontally scaled, these strategies are not enough to guarantee per-IP or per-feed
-// limits, as the in-memory implementations are only aware of the clients/peers connected
-// to the other instances
+// If horiziontally scaled, the in-memory implementations of these strategies are not enough
+// to guarantee per-IP or per-feed limits, as they are unaware of the clients/peers connected
+// to the other instances.
 //
 // Instead, we can either
 // 1) deploy the Nacre instances behind a load balancer (like HAProxy)
 //     that has built-in support for these strategies, or
-// 2) extend in-application support for distributed rate limiting
-//    (e.g. via database-backed expiring semaphores and bandwidth quotas)
+// 2) use the Redis-backed implementation, which tracks clients/peers across
+//    all instances using expiring semaphores (see rate_limit_redis.go)
+
+const (
+	defaultMaxClientsPerIP   = 5
+	defaultMaxPeersPerFeedID = 3
+
+	defaultMaxFailedPasswordsPerIP     = 10
+	defaultMaxFailedPasswordsPerFeedID = 50
+	failedPasswordWindow               = time.Minute * 15
+)
 
 type empty struct{}
 type semaphore chan empty
@@ -36,6 +46,17 @@ type RateLimiter interface {
 	TryAddPeer(ctx context.Context, id string) bool
 	// RemovePeer from the rate limiter.
 	RemovePeer(ctx context.Context, id string) bool
+	// AllowPasswordAttempt returns false if too many incorrect passwords were recently
+	// entered from the IP, or for the feed ID.
+	AllowPasswordAttempt(ctx context.Context, ip string, id string) bool
+	// FailPasswordAttempt records an incorrect password entered from the IP for the feed ID.
+	FailPasswordAttempt(ctx context.Context, ip string, id string)
+}
+
+// failureWindow counts failures until the window resets.
+type failureWindow struct {
+	count   int
+	resetAt time.Time
 }
 
 // inMemoryRateLimiter is a barebones RateLimiter implementation for tracking clients and peers.
@@ -49,9 +70,16 @@ type inMemoryRateLimiter struct {
 	clients map[string]semaphore
 	peers   map[string]semaphore
 
+	// Incorrect passwords by IP and by feed ID
+	ipPasswordFailures   map[string]*failureWindow
+	feedPasswordFailures map[string]*failureWindow
+
 	maxClientsPerIP   int // Maximum # of concurrent clients per IP for this rate limiter
 	maxPeersPerFeedID int // Maximum # of concurrent peers per feed ID for this rate limiter
 
+	maxFailedPasswordsPerIP     int
+	maxFailedPasswordsPerFeedID int
+
 	numRemovedClients   int
 	numRemovedPeers     int
 	gcMaxRemovedClients int
@@ -75,14 +103,19 @@ func NewInMemoryRateLimiter() RateLimiter {
 		mu:                  sync.Mutex{},
 		clients:             make(map[string]semaphore),
 		peers:               make(map[string]semaphore),
-		maxClientsPerIP:     5,
-		maxPeersPerFeedID:   3,
+		maxClientsPerIP:     defaultMaxClientsPerIP,
+		maxPeersPerFeedID:   defaultMaxPeersPerFeedID,
 		numRemovedClients:   0,
 		numRemovedPeers:     0,
 		gcMaxRemovedClients: 10_000,
 		gcMaxRemovedPeers:   10_000,
 		gcPeriod:            time.Second * 30,
 		quit:                make(chan empty),
+
+		ipPasswordFailures:          make(map[string]*failureWindow),
+		feedPasswordFailures:        make(map[string]*failureWindow),
+		maxFailedPasswordsPerIP:     defaultMaxFailedPasswordsPerIP,
+		maxFailedPasswordsPerFeedID: defaultMaxFailedPasswordsPerFeedID,
 	}
 	go r.garbageCollectLoop(context.Background())
 	return r
@@ -162,6 +195,42 @@ func (r *inMemoryRateLimiter) RemovePeer(ctx context.Context, ip string) bool {
 	}
 }
 
+// AllowPasswordAttempt returns 'false' if the IP or the feed ID has used up its
+// incorrect passwords for the current window.
+func (r *inMemoryRateLimiter) AllowPasswordAttempt(ctx context.Context, ip string, id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if w, ok := r.ipPasswordFailures[ip]; ok && now.Before(w.resetAt) && w.count >= r.maxFailedPasswordsPerIP {
+		return false
+	}
+	if w, ok := r.feedPasswordFailures[id]; ok && now.Before(w.resetAt) && w.count >= r.maxFailedPasswordsPerFeedID {
+		return false
+	}
+	return true
+}
+
+// FailPasswordAttempt counts an incorrect password against both the IP and the feed ID.
+func (r *inMemoryRateLimiter) FailPasswordAttempt(ctx context.Context, ip string, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for _, failures := range []struct {
+		windows map[string]*failureWindow
+		key     string
+	}{
+		{r.ipPasswordFailures, ip},
+		{r.feedPasswordFailures, id},
+	} {
+		w, ok := failures.windows[failures.key]
+		if !ok || !now.Before(w.resetAt) {
+			w = &failureWindow{resetAt: now.Add(failedPasswordWindow)}
+			failures.windows[failures.key] = w
+		}
+		w.count++
+	}
+}
+
 func (r *inMemoryRateLimiter) garbageCollectLoop(ctx context.Context) {
 	ticker := time.NewTicker(r.gcPeriod)
 	for {
@@ -180,6 +249,15 @@ func (r *inMemoryRateLimiter) garbageCollect() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	now := time.Now()
+	for _, windows := range []map[string]*failureWindow{r.ipPasswordFailures, r.feedPasswordFailures} {
+		for key, w := range windows {
+			if !now.Before(w.resetAt) {
+				delete(windows, key)
+			}
+		}
+	}
+
 	if r.numRemovedClients < r.gcMaxRemovedClients && r.numRemovedPeers < r.gcMaxRemovedPeers {
 		// Nothing to do
 		return
@@ -0,0 +1,269 @@
+package nacre
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+const (
+	rateLimitLeaseDuration = time.Second * 30
+	rateLimitRenewPeriod   = time.Second * 10
+)
+
+// acquireLeaseScript atomically acquires a slot in an expiring semaphore.
+//
+// The semaphore is a sorted set of lease IDs scored by their expiration time.
+// Expired leases, such as those held by crashed instances, are removed before
+// counting the semaphore's holders.
+//
+// KEYS: semaphore
+// ARGV: now (ms), limit, lease expiration (ms), lease ID, lease duration (ms)
+var acquireLeaseScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return 1
+`)
+
+// failPasswordScript counts an incorrect password in fixed windows which start with
+// the first failure.
+//
+// KEYS: failure counters
+// ARGV: window duration (ms)
+var failPasswordScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	if redis.call('INCR', key) == 1 then
+		redis.call('PEXPIRE', key, ARGV[1])
+	end
+end
+return 0
+`)
+
+// redisRateLimiter is a RateLimiter implementation which enforces its limits across all
+// nacre instances sharing the same Redis server.
+//
+// Every client/peer holds a lease in a Redis-backed expiring semaphore. Leases held by
+// this instance are periodically renewed in the background, so that the slots of a
+// crashed instance are released once its leases expire.
+type redisRateLimiter struct {
+	client *redis.Client
+
+	mu     sync.Mutex
+	leases map[string][]string // Lease IDs held by this instance, by semaphore key
+
+	maxClientsPerIP   int
+	maxPeersPerFeedID int
+	leaseDuration     time.Duration
+	renewPeriod       time.Duration
+
+	maxFailedPasswordsPerIP     int
+	maxFailedPasswordsPerFeedID int
+
+	quit     chan empty
+	quitOnce sync.Once
+}
+
+var _ RateLimiter = (*redisRateLimiter)(nil)
+
+// NewRedisRateLimiter returns a Redis-backed rate limiter for managing incoming peer/client
+// requests across horizontally-scaled instances. It also spins off a new background goroutine
+// for renewing the instance's leases, which can be stopped with redisRateLimiter.Stop().
+//
+// If Redis is unavailable, the rate limiter lets requests through rather than rejecting them.
+func NewRedisRateLimiter(client *redis.Client) RateLimiter {
+	r := &redisRateLimiter{
+		client:            client,
+		mu:                sync.Mutex{},
+		leases:            make(map[string][]string),
+		maxClientsPerIP:   defaultMaxClientsPerIP,
+		maxPeersPerFeedID: defaultMaxPeersPerFeedID,
+		leaseDuration:     rateLimitLeaseDuration,
+		renewPeriod:       rateLimitRenewPeriod,
+		quit:              make(chan empty),
+
+		maxFailedPasswordsPerIP:     defaultMaxFailedPasswordsPerIP,
+		maxFailedPasswordsPerFeedID: defaultMaxFailedPasswordsPerFeedID,
+	}
+	go r.renewLoop(context.Background())
+	return r
+}
+
+// Stop the background renewal goroutine and release all leases held by this instance.
+func (r *redisRateLimiter) Stop() {
+	r.quitOnce.Do(func() { close(r.quit) })
+
+	r.mu.Lock()
+	leases := r.leases
+	r.leases = make(map[string][]string)
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.renewPeriod)
+	defer cancel()
+	pipe := r.client.Pipeline()
+	for key, ids := range leases {
+		for _, id := range ids {
+			pipe.ZRem(ctx, key, id)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		log.Printf("error: failed to release rate limiter leases: %s\n", err.Error())
+	}
+}
+
+// TryAddClient for the IP. Returns 'true' if the client is successfully added,
+// otherwise 'false'.
+func (r *redisRateLimiter) TryAddClient(ctx context.Context, ip string) bool {
+	return r.acquire(ctx, clientSemaphoreKey(ip), r.maxClientsPerIP)
+}
+
+// RemoveClient releases one of this instance's leases for the IP.
+func (r *redisRateLimiter) RemoveClient(ctx context.Context, ip string) bool {
+	return r.release(ctx, clientSemaphoreKey(ip))
+}
+
+// TryAddPeer for the feed ID. Returns 'true' if the peer is successfully added,
+// otherwise 'false'.
+func (r *redisRateLimiter) TryAddPeer(ctx context.Context, id string) bool {
+	return r.acquire(ctx, peerSemaphoreKey(id), r.maxPeersPerFeedID)
+}
+
+// RemovePeer releases one of this instance's leases for the feed ID.
+func (r *redisRateLimiter) RemovePeer(ctx context.Context, id string) bool {
+	return r.release(ctx, peerSemaphoreKey(id))
+}
+
+// AllowPasswordAttempt returns 'false' if the IP or the feed ID has used up its
+// incorrect passwords for the current window.
+func (r *redisRateLimiter) AllowPasswordAttempt(ctx context.Context, ip string, id string) bool {
+	counts, err := r.client.MGet(ctx, ipPasswordFailuresKey(ip), feedPasswordFailuresKey(id)).Result()
+	if err != nil {
+		log.Printf("error: failed to read password failures: %s\n", err.Error())
+		return true
+	}
+	limits := []int{r.maxFailedPasswordsPerIP, r.maxFailedPasswordsPerFeedID}
+	for i, count := range counts {
+		v, ok := count.(string)
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(v); err == nil && n >= limits[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// FailPasswordAttempt counts an incorrect password against both the IP and the feed ID.
+func (r *redisRateLimiter) FailPasswordAttempt(ctx context.Context, ip string, id string) {
+	keys := []string{ipPasswordFailuresKey(ip), feedPasswordFailuresKey(id)}
+	if err := failPasswordScript.Run(ctx, r.client, keys, failedPasswordWindow.Milliseconds()).Err(); err != nil {
+		log.Printf("error: failed to record password failure: %s\n", err.Error())
+	}
+}
+
+func (r *redisRateLimiter) acquire(ctx context.Context, key string, limit int) bool {
+	lease := uuid.NewString()
+	now := time.Now()
+	keys := []string{key}
+	args := []interface{}{
+		now.UnixMilli(),
+		limit,
+		now.Add(r.leaseDuration).UnixMilli(),
+		lease,
+		r.leaseDuration.Milliseconds(),
+	}
+	acquired, err := acquireLeaseScript.Run(ctx, r.client, keys, args...).Int()
+	if err != nil {
+		log.Printf("error: failed to acquire rate limiter lease for %s: %s\n", key, err.Error())
+		return true
+	}
+	if acquired == 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.leases[key] = append(r.leases[key], lease)
+	return true
+}
+
+func (r *redisRateLimiter) release(ctx context.Context, key string) bool {
+	r.mu.Lock()
+	ids := r.leases[key]
+	if len(ids) == 0 {
+		// Redis was unavailable when the lease should have been acquired
+		r.mu.Unlock()
+		return false
+	}
+	lease := ids[len(ids)-1]
+	if len(ids) == 1 {
+		delete(r.leases, key)
+	} else {
+		r.leases[key] = ids[:len(ids)-1]
+	}
+	r.mu.Unlock()
+
+	if err := r.client.ZRem(ctx, key, lease).Err(); err != nil {
+		// The lease expires on its own now that it is no longer renewed
+		log.Printf("error: failed to release rate limiter lease for %s: %s\n", key, err.Error())
+		return false
+	}
+	return true
+}
+
+func (r *redisRateLimiter) renewLoop(ctx context.Context) {
+	ticker := time.NewTicker(r.renewPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.renew(ctx); err != nil {
+				log.Printf("error: failed to renew rate limiter leases: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// renew extends the expiration of all leases held by this instance.
+func (r *redisRateLimiter) renew(ctx context.Context) error {
+	r.mu.Lock()
+	expiresAt := float64(time.Now().Add(r.leaseDuration).UnixMilli())
+	pipe := r.client.Pipeline()
+	for key, ids := range r.leases {
+		members := make([]redis.Z, len(ids))
+		for i, id := range ids {
+			members[i] = redis.Z{Score: expiresAt, Member: id}
+		}
+		pipe.ZAddXX(ctx, key, members...)
+		pipe.PExpire(ctx, key, r.leaseDuration)
+	}
+	r.mu.Unlock()
+
+	if pipe.Len() == 0 {
+		return nil
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func clientSemaphoreKey(ip string) string { return fmt.Sprintf("nacre:ratelimit:client:%s", ip) }
+func peerSemaphoreKey(id string) string   { return fmt.Sprintf("nacre:ratelimit:peer:%s", id) }
+func ipPasswordFailuresKey(ip string) string {
+	return fmt.Sprintf("nacre:ratelimit:password:ip:%s", ip)
+}
+func feedPasswordFailuresKey(id string) string {
+	return fmt.Sprintf("nacre:ratelimit:password:feed:%s", id)
+}
@@ -0,0 +1,111 @@
+package nacre
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v9"
+)
+
+// newTestRedisRateLimiter returns a rate limiter which allows two clients per IP and two
+// peers per feed ID, and whose leases expire and are renewed after the given durations.
+func newTestRedisRateLimiter(t *testing.T, client *redis.Client, leaseDuration time.Duration, renewPeriod time.Duration) *redisRateLimiter {
+	t.Helper()
+	r := &redisRateLimiter{
+		client:            client,
+		leases:            make(map[string][]string),
+		maxClientsPerIP:   2,
+		maxPeersPerFeedID: 2,
+		leaseDuration:     leaseDuration,
+		renewPeriod:       renewPeriod,
+		quit:              make(chan empty),
+
+		maxFailedPasswordsPerIP:     defaultMaxFailedPasswordsPerIP,
+		maxFailedPasswordsPerFeedID: defaultMaxFailedPasswordsPerFeedID,
+	}
+	go r.renewLoop(context.Background())
+	t.Cleanup(r.Stop)
+	return r
+}
+
+func TestRedisRateLimiterConcurrentLimit(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		add    func(r *redisRateLimiter, key string) bool
+		remove func(r *redisRateLimiter, key string) bool
+	}{
+		{
+			name:   "clients",
+			add:    func(r *redisRateLimiter, ip string) bool { return r.TryAddClient(ctx, ip) },
+			remove: func(r *redisRateLimiter, ip string) bool { return r.RemoveClient(ctx, ip) },
+		},
+		{
+			name:   "peers",
+			add:    func(r *redisRateLimiter, id string) bool { return r.TryAddPeer(ctx, id) },
+			remove: func(r *redisRateLimiter, id string) bool { return r.RemovePeer(ctx, id) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+			// Two instances share the limit through Redis
+			a := newTestRedisRateLimiter(t, client, time.Minute, time.Minute)
+			b := newTestRedisRateLimiter(t, client, time.Minute, time.Minute)
+
+			if !tt.add(a, "key") || !tt.add(b, "key") {
+				t.Fatal("rejected below the limit")
+			}
+			if tt.add(a, "key") || tt.add(b, "key") {
+				t.Error("accepted above the limit")
+			}
+			if !tt.add(a, "other") {
+				t.Error("rejected below the limit of another key")
+			}
+			if tt.remove(b, "other") {
+				t.Error("released a lease held by another instance")
+			}
+			if !tt.remove(a, "key") {
+				t.Error("failed to release a held lease")
+			}
+			if !tt.add(b, "key") {
+				t.Error("released slot was not reused")
+			}
+			if tt.add(a, "key") {
+				t.Error("accepted above the limit after reusing a slot")
+			}
+		})
+	}
+}
+
+func TestRedisRateLimiterExpiredLeases(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		crashed bool // Whether the instance holding the leases stops renewing them
+		want    bool
+	}{
+		{name: "renewed leases", crashed: false, want: false},
+		{name: "crashed instance", crashed: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+			holder := newTestRedisRateLimiter(t, client, time.Millisecond*200, time.Millisecond*50)
+			other := newTestRedisRateLimiter(t, client, time.Minute, time.Minute)
+			if !holder.TryAddClient(ctx, "192.0.2.1") || !holder.TryAddClient(ctx, "192.0.2.1") {
+				t.Fatal("rejected below the limit")
+			}
+			if tt.crashed {
+				// Stopping the renewal without releasing the leases mimics a crash
+				holder.quitOnce.Do(func() { close(holder.quit) })
+			}
+			time.Sleep(time.Millisecond * 500)
+			if got := other.TryAddClient(ctx, "192.0.2.1"); got != tt.want {
+				t.Errorf("TryAddClient() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package nacre
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const maxReplaySpeed = 100
+
+// Replay control actions sent by peers.
+const (
+	replayActionPlay  = "play"
+	replayActionPause = "pause"
+	replayActionSpeed = "speed"
+	replayActionSeek  = "seek"
+)
+
+// Replay status types sent to peers.
+const (
+	replayStatusTypeStatus = "status"
+	replayStatusTypeReset  = "reset"
+)
+
+// replayOptions configures how a finished feed is replayed to a peer.
+type replayOptions struct {
+	speed   float64       // Playback speed multiplier
+	maxIdle time.Duration // Maximum pause between two entries, or 0 for no limit
+}
+
+// replayControl is a text message sent by a peer to control an ongoing replay.
+type replayControl struct {
+	Action   string  `json:"action"`
+	Speed    float64 `json:"speed,omitempty"`
+	Position float64 `json:"position,omitempty"` // Seconds from the start of the replay
+}
+
+// replayStatus is a text message informing the peer of the current state of the replay.
+// A status of type 'reset' tells the peer to clear its terminal before receiving the
+// entries up to the (new) position.
+type replayStatus struct {
+	Type     string  `json:"type"`
+	Position float64 `json:"position"`
+	Duration float64 `json:"duration"`
+	Speed    float64 `json:"speed"`
+	Paused   bool    `json:"paused"`
+	Finished bool    `json:"finished"`
+}
+
+// replay keeps track of the playback position within a feed's entries.
+//
+// Each entry is scheduled at the time it was received relative to the first entry,
+// where gaps between entries are capped at the configured maximum idle time.
+type replay struct {
+	entries  []Entry
+	schedule []time.Duration
+	speed    float64
+	paused   bool
+
+	next      int           // Index of the next entry to emit
+	position  time.Duration // Playback position as of 'updatedAt'
+	updatedAt time.Time
+}
+
+func newReplay(entries []Entry, opts replayOptions) *replay {
+	if isTruncated(entries) {
+		// Let the peer know that the replay does not start at the beginning of the feed
+		marker := Entry{Truncated: true, Time: entries[0].Time}
+		entries = append([]Entry{marker}, entries...)
+	}
+	schedule := make([]time.Duration, len(entries))
+	for i := 1; i < len(entries); i++ {
+		gap := entries[i].Time.Sub(entries[i-1].Time)
+		if gap < 0 {
+			gap = 0
+		}
+		if opts.maxIdle > 0 && gap > opts.maxIdle {
+			gap = opts.maxIdle
+		}
+		schedule[i] = schedule[i-1] + gap
+	}
+	return &replay{
+		entries:   entries,
+		schedule:  schedule,
+		speed:     opts.speed,
+		updatedAt: time.Now(),
+	}
+}
+
+func (r *replay) duration() time.Duration {
+	if len(r.schedule) == 0 {
+		return 0
+	}
+	return r.schedule[len(r.schedule)-1]
+}
+
+func (r *replay) finished() bool { return r.next >= len(r.entries) }
+
+// currentPosition returns the playback position at the current point in time.
+func (r *replay) currentPosition() time.Duration {
+	if r.paused || r.finished() {
+		return r.position
+	}
+	position := r.position + time.Duration(float64(time.Since(r.updatedAt))*r.speed)
+	if next := r.schedule[r.next]; position > next {
+		// Never move past an entry that has yet to be emitted
+		return next
+	}
+	return position
+}
+
+// setPosition moves the playback position from the current one, returning 'true' if it
+// moved backwards, in which case all entries up to the new position need to be re-emitted.
+func (r *replay) setPosition(position time.Duration, current time.Duration) bool {
+	if position < 0 {
+		position = 0
+	} else if position > r.duration() {
+		position = r.duration()
+	}
+	rewound := position < current
+	if rewound {
+		r.next = 0
+	}
+	r.position = position
+	r.updatedAt = time.Now()
+	return rewound
+}
+
+// due returns the entries scheduled at or before the current playback position.
+func (r *replay) due() []Entry {
+	position := r.currentPosition()
+	r.position, r.updatedAt = position, time.Now()
+	start := r.next
+	for r.next < len(r.entries) && r.schedule[r.next] <= position {
+		r.next++
+	}
+	return r.entries[start:r.next]
+}
+
+// untilNext returns the wall-clock time until the next entry is due.
+func (r *replay) untilNext() time.Duration {
+	return time.Duration(float64(r.schedule[r.next]-r.currentPosition()) / r.speed)
+}
+
+func (r *replay) apply(control replayControl) (rewound bool) {
+	current := r.currentPosition()
+	position := current
+	switch control.Action {
+	case replayActionPlay:
+		if r.finished() {
+			// Start over when playing a finished replay
+			position = 0
+		}
+		r.paused = false
+	case replayActionPause:
+		r.paused = true
+	case replayActionSpeed:
+		if control.Speed > 0 && control.Speed <= maxReplaySpeed {
+			r.speed = control.Speed
+		}
+	case replayActionSeek:
+		position = time.Duration(control.Position * float64(time.Second))
+	}
+	return r.setPosition(position, current)
+}
+
+func (r *replay) status(statusType string) replayStatus {
+	return replayStatus{
+		Type:     statusType,
+		Position: r.currentPosition().Seconds(),
+		Duration: r.duration().Seconds(),
+		Speed:    r.speed,
+		Paused:   r.paused,
+		Finished: r.finished(),
+	}
+}
+
+// replayLoop pushes the feed's entries to the connected peer at the pace in which they
+// were originally received, while handling the peer's replay controls.
+func (peer *Peer) replayLoop(ctx context.Context, id string, opts replayOptions) error {
+	entries, err := peer.hub.GetEntries(ctx, id)
+	if err != nil {
+		return err
+	}
+	r := newReplay(entries, opts)
+	if err := peer.writeReplayStatus(r.status(replayStatusTypeStatus)); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		if !r.paused && !r.finished() {
+			for _, entry := range r.due() {
+				if err := peer.writeEntry(entry); err != nil {
+					return err
+				}
+			}
+			if err := peer.writeReplayStatus(r.status(replayStatusTypeStatus)); err != nil {
+				return err
+			}
+		}
+		var next <-chan time.Time
+		if !r.paused && !r.finished() {
+			timer.Reset(r.untilNext())
+			next = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return peer.closeContextDone()
+		case <-peer.quit:
+			return peer.closeShutdown()
+		case <-next: // Next entry is due
+		case control := <-peer.controls:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			statusType := replayStatusTypeStatus
+			if rewound := r.apply(control); rewound {
+				statusType = replayStatusTypeReset
+			}
+			if err := peer.writeReplayStatus(r.status(statusType)); err != nil {
+				return err
+			}
+			// Catch up to the new position without waiting for the entries' schedule
+			for _, entry := range r.due() {
+				if err := peer.writeEntry(entry); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			peer.conn.SetWriteDeadline(time.Now().Add(writeDeadline))
+			if err := peer.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				if errors.Is(err, websocket.ErrCloseSent) {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+}
+
+func (peer *Peer) writeEntry(entry Entry) error {
+	peer.conn.SetWriteDeadline(time.Now().Add(writeDeadline))
+	if err := peer.conn.WriteMessage(websocket.BinaryMessage, encodeEntry(entry)); err != nil {
+		return err
+	}
+	observeServedEntries("websocket", entry)
+	return nil
+}
+
+func (peer *Peer) writeReplayStatus(status replayStatus) error {
+	msg, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	peer.conn.SetWriteDeadline(time.Now().Add(writeDeadline))
+	return peer.conn.WriteMessage(websocket.TextMessage, msg)
+}
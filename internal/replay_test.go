@@ -0,0 +1,124 @@
+package nacre
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// replayEntries returns entries received at the provided offsets from a fixed start.
+func replayEntries(offsets ...time.Duration) []Entry {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := make([]Entry, len(offsets))
+	for i, offset := range offsets {
+		entries[i] = Entry{ID: string(rune('a' + i)), Time: start.Add(offset)}
+	}
+	return entries
+}
+
+func TestReplaySchedule(t *testing.T) {
+	s := time.Second
+	truncated := replayEntries(0, 2*s)
+	truncated[0].Offset = 100
+
+	tests := []struct {
+		name    string
+		entries []Entry
+		maxIdle time.Duration
+		want    []time.Duration
+	}{
+		{name: "no entries", entries: nil, want: []time.Duration{}},
+		{name: "single entry", entries: replayEntries(5 * s), want: []time.Duration{0}},
+		{name: "relative to first entry", entries: replayEntries(5*s, 6*s, 9*s), want: []time.Duration{0, s, 4 * s}},
+		{name: "capped gaps", entries: replayEntries(0, s, 61*s, 62*s), maxIdle: 2 * s, want: []time.Duration{0, s, 3 * s, 4 * s}},
+		{name: "out of order times", entries: replayEntries(0, 2*s, s, 3*s), want: []time.Duration{0, 2 * s, 2 * s, 4 * s}},
+		{name: "truncated marker", entries: truncated, want: []time.Duration{0, 0, 2 * s}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReplay(tt.entries, replayOptions{speed: 1, maxIdle: tt.maxIdle})
+			if !reflect.DeepEqual(r.schedule, tt.want) {
+				t.Errorf("schedule = %v, want %v", r.schedule, tt.want)
+			}
+			if len(tt.want) > 0 && r.duration() != tt.want[len(tt.want)-1] {
+				t.Errorf("duration = %s, want %s", r.duration(), tt.want[len(tt.want)-1])
+			}
+		})
+	}
+	if r := newReplay(truncated, replayOptions{speed: 1}); !r.entries[0].Truncated {
+		t.Errorf("truncated replay does not start with a truncated marker")
+	}
+}
+
+func TestReplayControls(t *testing.T) {
+	s := time.Second
+	entries := replayEntries(0, s, 2*s, 3*s, 4*s)
+
+	type step struct {
+		control     replayControl
+		wantRewound bool
+		wantDue     []string // IDs of the entries due after the control
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "seek forward",
+			steps: []step{
+				{control: replayControl{Action: replayActionSeek, Position: 2.5}, wantDue: []string{"a", "b", "c"}},
+				{control: replayControl{Action: replayActionSeek, Position: 3}, wantDue: []string{"d"}},
+			},
+		},
+		{
+			name: "seek backwards re-emits entries",
+			steps: []step{
+				{control: replayControl{Action: replayActionSeek, Position: 3}, wantDue: []string{"a", "b", "c", "d"}},
+				{control: replayControl{Action: replayActionSeek, Position: 1}, wantRewound: true, wantDue: []string{"a", "b"}},
+			},
+		},
+		{
+			name: "seek is clamped to the replay",
+			steps: []step{
+				{control: replayControl{Action: replayActionSeek, Position: 60}, wantDue: []string{"a", "b", "c", "d", "e"}},
+				{control: replayControl{Action: replayActionSeek, Position: -5}, wantRewound: true, wantDue: []string{"a"}},
+			},
+		},
+		{
+			name: "playing a finished replay starts over",
+			steps: []step{
+				{control: replayControl{Action: replayActionSeek, Position: 4}, wantDue: []string{"a", "b", "c", "d", "e"}},
+				{control: replayControl{Action: replayActionPlay}, wantRewound: true, wantDue: []string{"a"}},
+			},
+		},
+		{
+			name: "invalid speed is ignored",
+			steps: []step{
+				{control: replayControl{Action: replayActionSpeed, Speed: maxReplaySpeed + 1}, wantDue: []string{"a"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReplay(entries, replayOptions{speed: 1})
+			// Pausing keeps the position from moving while the test runs, except after
+			// playing, where the next entry is still a second away
+			r.apply(replayControl{Action: replayActionPause})
+			for i, step := range tt.steps {
+				if rewound := r.apply(step.control); rewound != step.wantRewound {
+					t.Errorf("step %d: rewound = %t, want %t", i, rewound, step.wantRewound)
+				}
+				var due []string
+				for _, entry := range r.due() {
+					due = append(due, entry.ID)
+				}
+				if !reflect.DeepEqual(due, step.wantDue) {
+					t.Errorf("step %d: due = %v, want %v", i, due, step.wantDue)
+				}
+			}
+			if r.speed != 1 {
+				t.Errorf("speed = %v, want 1", r.speed)
+			}
+		})
+	}
+}
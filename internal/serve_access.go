@@ -0,0 +1,147 @@
+package nacre
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/johanmickos/nacre/internal/ws"
+)
+
+// viewCookiePrefix prefixes the names of the cookies which hold the view keys of
+// protected feeds whose password the viewer entered. Each feed has its own cookie.
+const viewCookiePrefix = "nacre_view_"
+
+// headerViewKey carries the view key of a password-protected feed, which API and
+// websocket clients obtain by exchanging the feed's password at /api/v1/feeds/${id}/access.
+const headerViewKey = "X-Nacre-View-Key"
+
+var (
+	errIncorrectPassword = errors.New("incorrect password")
+	errTooManyPasswords  = errors.New("too many incorrect passwords, try again later")
+)
+
+// canViewFeed returns true if the request may read the identified feed. Public feeds can
+// be read by anyone, while password-protected feeds require the feed's view key, either
+// in the X-Nacre-View-Key header, in the 'view_key' query parameter or in the cookie set
+// by the password form.
+//
+// Unlike passwords, view keys are cheap to verify. Passwords are only accepted by the
+// password form and the access endpoint, which rate limit incorrect passwords.
+func (s *HTTPServer) canViewFeed(r *http.Request, id string) (bool, error) {
+	secret, err := s.hub.FeedSecret(r.Context(), id)
+	if err != nil {
+		return false, err
+	}
+	if secret == "" {
+		return true, nil
+	}
+	key := r.Header.Get(headerViewKey)
+	if key == "" {
+		key = r.URL.Query().Get(ws.ViewKeyParam)
+	}
+	if cookie, err := r.Cookie(viewCookiePrefix + id); err == nil && key == "" {
+		key = cookie.Value
+	}
+	return verifyFeedViewKey(id, secret, key), nil
+}
+
+// exchangePassword verifies the identified feed's password, returning the feed's view key,
+// or an empty key if the feed is public. Incorrect passwords count against both the
+// client's IP and the feed, and further attempts fail with errTooManyPasswords once
+// either has used up its budget.
+func (s *HTTPServer) exchangePassword(ctx context.Context, r *http.Request, id string, password string) (string, error) {
+	secret, err := s.hub.FeedSecret(ctx, id)
+	if err != nil || secret == "" {
+		return "", err
+	}
+	clientIP, err := requestClientIP(r)
+	if err != nil {
+		return "", err
+	}
+	if !s.rateLimiter.AllowPasswordAttempt(ctx, clientIP, id) {
+		return "", errTooManyPasswords
+	}
+	if !verifyFeedPassword(password, secret) {
+		s.rateLimiter.FailPasswordAttempt(ctx, clientIP, id)
+		return "", errIncorrectPassword
+	}
+	return feedViewKey(id, secret), nil
+}
+
+// requireFeedAccess serves the password form in place of a protected feed's page until
+// the viewer enters the feed's password, which is posted back to the page's own URL.
+// Returns true if the page may be served.
+func (s *HTTPServer) requireFeedAccess(rw http.ResponseWriter, r *http.Request, id string) bool {
+	if r.Method == http.MethodPost {
+		s.handleFeedPassword(rw, r, id)
+		return false
+	}
+	if ok, err := s.canViewFeed(r, id); err != nil {
+		renderError(rw, r, err)
+		return false
+	} else if !ok {
+		renderFeedPasswordForm(rw, r, id, http.StatusUnauthorized, "")
+		return false
+	}
+	return true
+}
+
+// requireAPIFeedAccess is the JSON API's counterpart to requireFeedAccess.
+func (s *HTTPServer) requireAPIFeedAccess(rw http.ResponseWriter, r *http.Request, id string) bool {
+	if ok, err := s.canViewFeed(r, id); err != nil {
+		writeAPIError(rw, r, err)
+		return false
+	} else if !ok {
+		writeAPIError(rw, r, newUnauthorizedError(fmt.Sprintf("Feed %s is protected by a password", id)))
+		return false
+	}
+	return true
+}
+
+// handleFeedPassword verifies the password entered in the form and, if it is correct,
+// sets the feed's view cookie and redirects the viewer back to the page.
+func (s *HTTPServer) handleFeedPassword(rw http.ResponseWriter, r *http.Request, id string) {
+	key, err := s.exchangePassword(r.Context(), r, id, r.PostFormValue("password"))
+	switch {
+	case errors.Is(err, errIncorrectPassword):
+		renderFeedPasswordForm(rw, r, id, http.StatusUnauthorized, "Incorrect password, please try again.")
+		return
+	case errors.Is(err, errTooManyPasswords):
+		renderFeedPasswordForm(rw, r, id, http.StatusTooManyRequests, "Too many incorrect passwords, please try again later.")
+		return
+	case err != nil:
+		renderError(rw, r, err)
+		return
+	}
+	if key != "" {
+		http.SetCookie(rw, &http.Cookie{
+			Name:     viewCookiePrefix + id,
+			Value:    key,
+			Path:     "/",
+			Secure:   strings.HasPrefix(s.ingester.baseURL, "https://"),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	http.Redirect(rw, r, r.URL.RequestURI(), http.StatusSeeOther)
+}
+
+func renderFeedPasswordForm(rw http.ResponseWriter, r *http.Request, id string, status int, message string) {
+	data := struct {
+		FeedID  string
+		Message string
+	}{
+		FeedID:  id,
+		Message: message,
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	if err := feedPasswordTemplate.Execute(rw, data); err != nil {
+		http.Error(rw, "An error occurred on our end", http.StatusInternalServerError)
+		return
+	}
+}
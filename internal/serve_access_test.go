@@ -0,0 +1,152 @@
+package nacre
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/johanmickos/nacre/internal/ws"
+)
+
+func TestExchangePassword(t *testing.T) {
+	type attempt struct {
+		ip       string
+		feed     string
+		password string
+		wantErr  error
+	}
+	tests := []struct {
+		name     string
+		attempts []attempt
+	}{
+		{
+			name: "correct password",
+			attempts: []attempt{
+				{ip: "192.0.2.1", feed: "private", password: "hunter2"},
+			},
+		},
+		{
+			name: "public feed",
+			attempts: []attempt{
+				{ip: "192.0.2.1", feed: "public", password: "anything"},
+			},
+		},
+		{
+			name: "incorrect passwords are limited per IP",
+			attempts: []attempt{
+				{ip: "192.0.2.1", feed: "private", password: "a", wantErr: errIncorrectPassword},
+				{ip: "192.0.2.1", feed: "private", password: "b", wantErr: errIncorrectPassword},
+				{ip: "192.0.2.1", feed: "private", password: "hunter2", wantErr: errTooManyPasswords},
+				{ip: "192.0.2.2", feed: "private", password: "hunter2"},
+			},
+		},
+		{
+			name: "incorrect passwords are limited per feed",
+			attempts: []attempt{
+				{ip: "192.0.2.1", feed: "private", password: "a", wantErr: errIncorrectPassword},
+				{ip: "192.0.2.2", feed: "private", password: "b", wantErr: errIncorrectPassword},
+				{ip: "192.0.2.3", feed: "private", password: "c", wantErr: errIncorrectPassword},
+				{ip: "192.0.2.4", feed: "private", password: "hunter2", wantErr: errTooManyPasswords},
+			},
+		},
+		{
+			name: "correct passwords are not counted",
+			attempts: []attempt{
+				{ip: "192.0.2.1", feed: "private", password: "hunter2"},
+				{ip: "192.0.2.1", feed: "private", password: "hunter2"},
+				{ip: "192.0.2.1", feed: "private", password: "hunter2"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, secret := newTestAccessServer(t)
+			for i, attempt := range tt.attempts {
+				r := httptest.NewRequest("POST", "/api/v1/feeds/"+attempt.feed+"/access", nil)
+				r.RemoteAddr = attempt.ip + ":4711"
+				key, err := s.exchangePassword(r.Context(), r, attempt.feed, attempt.password)
+				if !errors.Is(err, attempt.wantErr) {
+					t.Fatalf("attempt %d: got error %v, want %v", i, err, attempt.wantErr)
+				}
+				wantKey := ""
+				if err == nil && attempt.feed == "private" {
+					wantKey = feedViewKey(attempt.feed, secret)
+				}
+				if key != wantKey {
+					t.Errorf("attempt %d: got key %q, want %q", i, key, wantKey)
+				}
+			}
+		})
+	}
+}
+
+func TestCanViewFeed(t *testing.T) {
+	s, secret := newTestAccessServer(t)
+	key := feedViewKey("private", secret)
+	tests := []struct {
+		name   string
+		feed   string
+		target string
+		header map[string]string
+		cookie string
+		want   bool
+	}{
+		{name: "public feed", feed: "public", want: true},
+		{name: "no key", feed: "private", want: false},
+		{name: "key in header", feed: "private", header: map[string]string{headerViewKey: key}, want: true},
+		{name: "key in query", feed: "private", target: "?" + ws.ViewKeyParam + "=" + key, want: true},
+		{name: "key in cookie", feed: "private", cookie: key, want: true},
+		{name: "incorrect key", feed: "private", header: map[string]string{headerViewKey: key + "0"}, want: false},
+		{name: "password instead of key", feed: "private", header: map[string]string{headerViewKey: "hunter2", headerPassword: "hunter2"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/feeds/"+tt.feed+tt.target, nil)
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			if tt.cookie != "" {
+				r.Header.Set("Cookie", viewCookiePrefix+tt.feed+"="+tt.cookie)
+			}
+			got, err := s.canViewFeed(r, tt.feed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("canViewFeed() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestAccessServer returns a server with a public feed and a feed protected by
+// the password "hunter2", whose rate limiter allows only a few incorrect passwords.
+func newTestAccessServer(t *testing.T) (*HTTPServer, string) {
+	t.Helper()
+	ctx := context.Background()
+	hub := NewMemoryHub(1024*1024, time.Hour)
+	t.Cleanup(func() { hub.Close() })
+	rateLimiter := NewInMemoryRateLimiter()
+	t.Cleanup(rateLimiter.Stop)
+	rateLimiter.(*inMemoryRateLimiter).maxFailedPasswordsPerIP = 2
+	rateLimiter.(*inMemoryRateLimiter).maxFailedPasswordsPerFeedID = 3
+
+	secret, err := hashFeedPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, feed := range []struct{ id, secret string }{{"public", ""}, {"private", secret}} {
+		if err := hub.Push(ctx, feed.id, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if feed.secret == "" {
+			continue
+		}
+		if err := hub.SetFeedSecret(ctx, feed.id, feed.secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &HTTPServer{hub: hub, rateLimiter: rateLimiter}, secret
+}
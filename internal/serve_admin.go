@@ -0,0 +1,136 @@
+package nacre
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const readinessCheckTimeout = time.Second * 2
+
+// Health check statuses.
+const (
+	healthStatusOK          = "ok"
+	healthStatusUnavailable = "unavailable"
+)
+
+// healthCheck is the outcome of checking a single dependency of the server.
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthResponse is the JSON body returned by the health and readiness endpoints.
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// ingestionListener is a server accepting producers' connections, such as the TCPServer.
+type ingestionListener interface {
+	Accepting() bool
+}
+
+// AdminServer serves nacre's operational endpoints, such as metrics and health checks,
+// on an address which is separate from the user-facing HTTP server.
+type AdminServer struct {
+	inner     *http.Server
+	mux       *http.ServeMux
+	hub       Hub
+	listeners map[string]ingestionListener // Ingestion listeners by name
+
+	draining int32 // Set to 1 once the server starts shutting down
+}
+
+// NewAdminServer allocates a HTTP server for serving nacre's operational endpoints.
+// Readiness requires the hub to be reachable and all provided listeners to be accepting.
+func NewAdminServer(address string, hub Hub, listeners map[string]ingestionListener) *AdminServer {
+	mux := http.NewServeMux()
+	server := &AdminServer{
+		inner: &http.Server{
+			Addr:    address,
+			Handler: mux,
+		},
+		mux:       mux,
+		hub:       hub,
+		listeners: listeners,
+	}
+	server.mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	server.mux.HandleFunc("/healthz", server.handleHealth)
+	server.mux.HandleFunc("/readyz", server.handleReady)
+	return server
+}
+
+// Serve admin traffic on the configured address until the server is shut down.
+func (s *AdminServer) Serve(ctx context.Context) error {
+	if err := s.inner.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Drain marks the server as draining, which fails all subsequent readiness checks.
+func (s *AdminServer) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+// Shutdown delegates to the inner http.Server's shutdown function.
+func (s *AdminServer) Shutdown(ctx context.Context) error {
+	s.Drain()
+	return s.inner.Shutdown(ctx)
+}
+
+// handleHealth reports that the process is alive and serving requests.
+func (s *AdminServer) handleHealth(rw http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(rw, healthResponse{Status: healthStatusOK})
+}
+
+// handleReady reports whether the server is able to serve producers and viewers.
+func (s *AdminServer) handleReady(rw http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	checks := make(map[string]healthCheck)
+	if err := s.hub.Ping(ctx); err != nil {
+		checks["hub"] = healthCheck{Status: healthStatusUnavailable, Error: err.Error()}
+	} else {
+		checks["hub"] = healthCheck{Status: healthStatusOK}
+	}
+	for name, listener := range s.listeners {
+		if listener.Accepting() {
+			checks[name] = healthCheck{Status: healthStatusOK}
+		} else {
+			checks[name] = healthCheck{Status: healthStatusUnavailable, Error: "listener is not accepting connections"}
+		}
+	}
+	if atomic.LoadInt32(&s.draining) == 1 {
+		checks["draining"] = healthCheck{Status: healthStatusUnavailable, Error: "server is shutting down"}
+	} else {
+		checks["draining"] = healthCheck{Status: healthStatusOK}
+	}
+
+	response := healthResponse{Status: healthStatusOK, Checks: checks}
+	for _, check := range checks {
+		if check.Status != healthStatusOK {
+			response.Status = healthStatusUnavailable
+		}
+	}
+	writeHealthResponse(rw, response)
+}
+
+func writeHealthResponse(rw http.ResponseWriter, response healthResponse) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	if response.Status != healthStatusOK {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(rw).Encode(response); err != nil {
+		log.Printf("Failed to write health response: %v", err)
+	}
+}
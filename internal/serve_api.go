@@ -0,0 +1,294 @@
+package nacre
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	apiDefaultPageSize = 100
+	apiMaxPageSize     = 1000
+)
+
+// Encodings of entry data in API responses.
+const (
+	apiEncodingUTF8   = "utf8"
+	apiEncodingBase64 = "base64"
+)
+
+// apiFeed is the JSON representation of a feed's metadata.
+type apiFeed struct {
+	ID                 string      `json:"id"`
+	Exists             bool        `json:"exists"`
+	ClientState        ClientState `json:"client_state"`
+	EntryCount         int64       `json:"entry_count"`
+	Bytes              int64       `json:"bytes"`
+	RetainedEntryCount int64       `json:"retained_entry_count"`
+	RetainedBytes      int64       `json:"retained_bytes"`
+	CreatedAt          *time.Time  `json:"created_at,omitempty"`
+	UpdatedAt          *time.Time  `json:"updated_at,omitempty"`
+}
+
+// apiEntry is the JSON representation of a feed entry.
+type apiEntry struct {
+	ID     string    `json:"id"`
+	Seq    int64     `json:"seq"`
+	Offset int64     `json:"offset"`
+	Time   time.Time `json:"time"`
+	Data   string    `json:"data"`
+}
+
+// apiEntriesPage is a page of feed entries. NextCursor identifies the last entry of the page
+// and can be passed as the 'cursor' parameter to fetch the following page, or to poll
+// for new entries once HasMore is false.
+type apiEntriesPage struct {
+	Entries    []apiEntry `json:"entries"`
+	NextCursor string     `json:"next_cursor"`
+	HasMore    bool       `json:"has_more"`
+}
+
+// apiAccess holds the view key which a password-protected feed's password was exchanged
+// for. The view key is empty for public feeds.
+type apiAccess struct {
+	ViewKey string `json:"view_key"`
+}
+
+// apiErrorResponse is the JSON body of failed API requests.
+type apiErrorResponse struct {
+	Error apiError `json:"error"`
+}
+
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// handleAPIFeeds serves the feed resources of the JSON API:
+//   - /api/v1/feeds/${feedID}
+//   - /api/v1/feeds/${feedID}/entries
+//   - /api/v1/feeds/${feedID}/events (see serve_sse.go)
+//   - /api/v1/feeds/${feedID}/access (POST only)
+func (s *HTTPServer) handleAPIFeeds(rw http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/feeds/"), "/")
+	if len(parts) == 2 && parts[0] != "" && parts[1] == "access" {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(rw, r, "POST")
+			return
+		}
+		s.handleAPIAccess(rw, r, parts[0])
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(rw, r, "GET, HEAD")
+		return
+	}
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		s.handleAPIFeed(rw, r, parts[0])
+	case len(parts) == 2 && parts[0] != "" && parts[1] == "entries":
+		s.handleAPIEntries(rw, r, parts[0])
+	case len(parts) == 2 && parts[0] != "" && parts[1] == "events":
+		s.handleEvents(rw, r, parts[0])
+	default:
+		writeAPIError(rw, r, newNotFoundError("Unsupported path"))
+	}
+}
+
+func (s *HTTPServer) handleAPIFeed(rw http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	exists, err := s.hub.FeedExists(ctx, id)
+	if err != nil {
+		writeAPIError(rw, r, err)
+		return
+	}
+	state, err := s.hub.ClientState(ctx, id)
+	if err != nil {
+		writeAPIError(rw, r, err)
+		return
+	}
+	if !exists && state != ClientStateConnected {
+		writeAPIError(rw, r, newNotFoundError(fmt.Sprintf("Feed %s does not exist", id)))
+		return
+	}
+	if !s.requireAPIFeedAccess(rw, r, id) {
+		return
+	}
+	info, err := s.hub.FeedInfo(ctx, id)
+	if err != nil {
+		writeAPIError(rw, r, err)
+		return
+	}
+	feed := apiFeed{
+		ID:                 id,
+		Exists:             exists,
+		ClientState:        state,
+		EntryCount:         info.Entries,
+		Bytes:              info.Bytes,
+		RetainedEntryCount: info.RetainedEntries,
+		RetainedBytes:      info.RetainedBytes,
+	}
+	if !info.Created.IsZero() {
+		feed.CreatedAt = &info.Created
+	}
+	if !info.Updated.IsZero() {
+		feed.UpdatedAt = &info.Updated
+	}
+	writeAPIResponse(rw, feed)
+}
+
+func (s *HTTPServer) handleAPIEntries(rw http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	limit, err := positiveIntParam(r, "limit", apiDefaultPageSize)
+	if err != nil {
+		writeAPIError(rw, r, newBadRequestError(err.Error()))
+		return
+	}
+	if limit > apiMaxPageSize {
+		limit = apiMaxPageSize
+	}
+	encoding, err := apiEncodingParam(r)
+	if err != nil {
+		writeAPIError(rw, r, newBadRequestError(err.Error()))
+		return
+	}
+	if exists, err := s.hub.FeedExists(ctx, id); err != nil {
+		writeAPIError(rw, r, err)
+		return
+	} else if !exists {
+		writeAPIError(rw, r, newNotFoundError(fmt.Sprintf("Feed %s does not exist", id)))
+		return
+	}
+	if !s.requireAPIFeedAccess(rw, r, id) {
+		return
+	}
+
+	cursor := query.Get("cursor")
+	// Fetch one more entry than requested to find out whether there are more
+	entries, err := s.hub.GetEntriesAfter(ctx, id, cursor, limit+1)
+	if errors.Is(err, errInvalidEntryID) {
+		writeAPIError(rw, r, newBadRequestError("invalid cursor parameter"))
+		return
+	} else if err != nil {
+		writeAPIError(rw, r, err)
+		return
+	}
+	page := apiEntriesPage{
+		Entries:    make([]apiEntry, 0, len(entries)),
+		NextCursor: cursor,
+		HasMore:    len(entries) > limit,
+	}
+	if page.HasMore {
+		entries = entries[:limit]
+	}
+	for _, entry := range entries {
+		page.Entries = append(page.Entries, newAPIEntry(entry, encoding))
+		page.NextCursor = entry.ID
+	}
+	writeAPIResponse(rw, page)
+	observeServedEntries("api", entries...)
+}
+
+// handleAPIAccess exchanges the password of a password-protected feed, sent in the
+// X-Nacre-Password header, for the feed's view key. Clients send the view key rather
+// than the password with their following requests, which spares the server from
+// verifying the password every time.
+func (s *HTTPServer) handleAPIAccess(rw http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	if exists, err := s.hub.FeedExists(ctx, id); err != nil {
+		writeAPIError(rw, r, err)
+		return
+	} else if !exists {
+		writeAPIError(rw, r, newNotFoundError(fmt.Sprintf("Feed %s does not exist", id)))
+		return
+	}
+	key, err := s.exchangePassword(ctx, r, id, r.Header.Get(headerPassword))
+	switch {
+	case errors.Is(err, errIncorrectPassword):
+		writeAPIError(rw, r, newUnauthorizedError("Incorrect password"))
+		return
+	case errors.Is(err, errTooManyPasswords):
+		writeAPIError(rw, r, renderableError{
+			StatusCode: http.StatusTooManyRequests,
+			Details:    "Too many incorrect passwords, try again later",
+		})
+		return
+	case err != nil:
+		writeAPIError(rw, r, err)
+		return
+	}
+	writeAPIResponse(rw, apiAccess{ViewKey: key})
+}
+
+// apiEncodingParam returns the requested encoding of entry data, defaulting to UTF-8.
+func apiEncodingParam(r *http.Request) (string, error) {
+	switch encoding := r.URL.Query().Get("encoding"); encoding {
+	case "":
+		return apiEncodingUTF8, nil
+	case apiEncodingUTF8, apiEncodingBase64:
+		return encoding, nil
+	default:
+		return "", errors.New("invalid encoding parameter: must be utf8 or base64")
+	}
+}
+
+func newAPIEntry(entry Entry, encoding string) apiEntry {
+	data := string(entry.Data)
+	if encoding == apiEncodingBase64 {
+		data = base64.StdEncoding.EncodeToString(entry.Data)
+	}
+	return apiEntry{
+		ID:     entry.ID,
+		Seq:    entry.Seq,
+		Offset: entry.Offset,
+		Time:   entry.Time,
+		Data:   data,
+	}
+}
+
+func writeAPIResponse(rw http.ResponseWriter, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Printf("Failed to write API response: %v", err)
+	}
+}
+
+// writeMethodNotAllowed rejects the request's method, listing the allowed methods.
+func writeMethodNotAllowed(rw http.ResponseWriter, r *http.Request, allow string) {
+	rw.Header().Set("Allow", allow)
+	writeAPIError(rw, r, renderableError{
+		StatusCode: http.StatusMethodNotAllowed,
+		Details:    fmt.Sprintf("Method %s is not allowed", r.Method),
+	})
+}
+
+// writeAPIError is the JSON API's counterpart to renderError.
+func writeAPIError(rw http.ResponseWriter, r *http.Request, err any) {
+	body := apiErrorResponse{
+		Error: apiError{
+			Status:  http.StatusInternalServerError,
+			Message: "We experienced an unexpected error on our end.",
+		},
+	}
+	if v, ok := err.(renderableError); ok {
+		body.Error.Status = v.StatusCode
+		body.Error.Message = v.Details
+		if body.Error.Message == "" {
+			body.Error.Message = v.Description
+		}
+	} else {
+		log.Printf("API error: %v", err)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(body.Error.Status)
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		log.Printf("Failed to write API error: %v", err)
+	}
+}
@@ -2,12 +2,16 @@ package nacre
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -15,31 +19,58 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// Templates are parsed relative to the working directory once the first HTTP server is
+// allocated, rather than when the package is loaded, so that the package can be used
+// from other directories, e.g. by tests.
 var (
-	homeTemplate          = template.Must(template.ParseFiles("./templates/home.gohtml"))
-	errorTemplate         = template.Must(template.ParseFiles("./templates/error.gohtml"))
-	liveFeedTemplate      = template.Must(template.ParseFiles("./templates/liveFeed.gohtml"))
-	plaintextFeedTemplate = template.Must(template.ParseFiles("./templates/plaintextFeed.gohtml"))
+	homeTemplate          *template.Template
+	errorTemplate         *template.Template
+	liveFeedTemplate      *template.Template
+	plaintextFeedTemplate *template.Template
+	feedPasswordTemplate  *template.Template
+
+	parseTemplatesOnce sync.Once
 )
 
+func parseTemplates() {
+	homeTemplate = template.Must(template.ParseFiles("./templates/home.gohtml"))
+	errorTemplate = template.Must(template.ParseFiles("./templates/error.gohtml"))
+	liveFeedTemplate = template.Must(template.ParseFiles("./templates/liveFeed.gohtml"))
+	plaintextFeedTemplate = template.Must(template.ParseFiles("./templates/plaintextFeed.gohtml"))
+	feedPasswordTemplate = template.Must(template.ParseFiles("./templates/feedPassword.gohtml"))
+}
+
 // HTTPServer handles nacre's HTTP requests and websocket upgrades.
 type HTTPServer struct {
 	inner       *http.Server
 	hub         Hub
 	rateLimiter RateLimiter
+	ingester    *ingester
 	mux         *http.ServeMux
 	wsUpgrader  websocket.Upgrader
+	// publishUpgrader accepts publishers from any origin, so that web-based tools
+	// hosted elsewhere can publish feeds.
+	publishUpgrader websocket.Upgrader
+
+	// quit is closed when the server shuts down, telling connected peers to go away.
+	// Hijacked websocket connections are not tracked by the inner http.Server,
+	// so they are tracked separately by 'peers'.
+	quit     chan empty
+	quitOnce sync.Once
+	peers    sync.WaitGroup
 
 	address string
 	bufsize int
 }
 
 // NewHTTPServer allocates a HTTP server for serving nacre's HTTP traffic.
-func NewHTTPServer(address string, hub Hub, rateLimiter RateLimiter) *HTTPServer {
+func NewHTTPServer(address string, trustedProxies CIDRs, baseURL string, hub Hub, rateLimiter RateLimiter, bandwidth BandwidthLimiter) *HTTPServer {
+	parseTemplatesOnce.Do(parseTemplates)
 	mux := http.NewServeMux()
 	server := &HTTPServer{
 		hub:         hub,
 		rateLimiter: rateLimiter,
+		ingester:    newIngester(baseURL, hub, rateLimiter, bandwidth),
 		inner: &http.Server{
 			Addr:    address,
 			Handler: mux,
@@ -49,30 +80,62 @@ func NewHTTPServer(address string, hub Hub, rateLimiter RateLimiter) *HTTPServer
 			WriteBufferSize: 1024,
 			ReadBufferSize:  1024,
 		},
+		publishUpgrader: websocket.Upgrader{
+			WriteBufferSize: 1024,
+			ReadBufferSize:  1024,
+			CheckOrigin:     func(r *http.Request) bool { return true },
+		},
+		quit: make(chan empty),
 
 		address: address,
 		bufsize: 1024,
 	}
-	middleware := func(next http.Handler) http.Handler { return withRecovery(withRequestID(next)) }
+	middleware := func(next http.Handler) http.Handler {
+		return withClientIP(trustedProxies, withRecovery(withRequestID(next)))
+	}
 
 	server.mux.Handle("/", middleware(http.HandlerFunc(handleHome)))
 	server.mux.Handle("/favicon.ico", http.HandlerFunc(handleFavicon))
 	server.mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
 	server.mux.Handle("/feed/", middleware(http.HandlerFunc(server.handleFeed)))
 	server.mux.Handle("/plaintext/", middleware(http.HandlerFunc(server.handlePlaintext)))
+	server.mux.Handle("/asciicast/", middleware(http.HandlerFunc(server.handleAsciicast)))
 	server.mux.Handle("/websocket", middleware(http.HandlerFunc(server.handleWebsocket)))
+	server.mux.Handle("/websocket/publish", middleware(http.HandlerFunc(server.handlePublish)))
+	server.mux.Handle("/api/v1/feeds/", middleware(http.HandlerFunc(server.handleAPIFeeds)))
+	server.mux.Handle("/ingest", middleware(http.HandlerFunc(server.handleIngest)))
 	return server
 }
 
-// Serve HTTP traffic on the configured address.
+// Serve HTTP traffic on the configured address until the server is shut down.
 func (s *HTTPServer) Serve(ctx context.Context) error {
 	s.inner.BaseContext = func(l net.Listener) context.Context { return ctx }
-	return s.inner.ListenAndServe()
+	if err := s.inner.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
-// Shutdown delegates to the inner http.Server's shutdown function.
+// Shutdown delegates to the inner http.Server's shutdown function, after which
+// it closes all websocket connections and waits for their peers to finish.
 func (s *HTTPServer) Shutdown(ctx context.Context) error {
-	return s.inner.Shutdown(ctx)
+	s.quitOnce.Do(func() { close(s.quit) })
+	if err := s.inner.Shutdown(ctx); err != nil {
+		return err
+	}
+	// The inner server has waited for all handlers to either finish or hijack their
+	// connection, so no more peers can be added at this point.
+	done := make(chan empty)
+	go func() {
+		s.peers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func handleFavicon(rw http.ResponseWriter, r *http.Request) {
@@ -90,7 +153,7 @@ func handleHome(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s HTTPServer) handleFeed(rw http.ResponseWriter, r *http.Request) {
+func (s *HTTPServer) handleFeed(rw http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")[1:]
 	if len(parts) != 2 {
 		// ["feed", "${feedID}"]
@@ -109,6 +172,9 @@ func (s HTTPServer) handleFeed(rw http.ResponseWriter, r *http.Request) {
 		renderError(rw, r, newNotFoundError(fmt.Sprintf("Feed %s does not exist", feedID)))
 		return
 	}
+	if !s.requireFeedAccess(rw, r, feedID) {
+		return
+	}
 	data := struct {
 		FeedID       string
 		PlaintextURL template.URL
@@ -124,7 +190,7 @@ func (s HTTPServer) handleFeed(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s HTTPServer) handlePlaintext(rw http.ResponseWriter, r *http.Request) {
+func (s *HTTPServer) handlePlaintext(rw http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")[1:]
 	if len(parts) != 2 {
 		// ["plaintext", "${feedID}"]
@@ -136,7 +202,10 @@ func (s HTTPServer) handlePlaintext(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 	id := parts[1]
-	entries, err := s.hub.GetAll(r.Context(), id)
+	if !s.requireFeedAccess(rw, r, id) {
+		return
+	}
+	entries, err := s.hub.GetEntries(r.Context(), id)
 	if err != nil {
 		renderError(rw, r, err)
 		return
@@ -146,24 +215,79 @@ func (s HTTPServer) handlePlaintext(rw http.ResponseWriter, r *http.Request) {
 		Entries []string
 	}{
 		FeedID:  id,
-		Entries: make([]string, len(entries)),
+		Entries: make([]string, 0, len(entries)+1),
+	}
+	if isTruncated(entries) {
+		data.Entries = append(data.Entries, truncationNotice)
 	}
-	for i, entry := range entries {
-		data.Entries[i] = string(entry)
+	for _, entry := range entries {
+		data.Entries = append(data.Entries, string(entry.Data))
 	}
 	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	if err := plaintextFeedTemplate.Execute(rw, data); err != nil {
 		renderError(rw, r, err)
 		return
 	}
+	observeServedEntries("plaintext", entries...)
+}
+
+func (s *HTTPServer) handleAsciicast(rw http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")[1:]
+	if len(parts) != 2 {
+		// ["asciicast", "${feedID}"]
+		renderError(rw, r, newBadRequestError("Unsupported path"))
+		return
+	}
+	if parts[0] != "asciicast" || len(parts[1]) == 0 {
+		renderError(rw, r, newBadRequestError("Unsupported path"))
+		return
+	}
+	id := parts[1]
+	width, err := positiveIntParam(r, "width", asciicastDefaultWidth)
+	if err != nil {
+		renderError(rw, r, newBadRequestError(err.Error()))
+		return
+	}
+	height, err := positiveIntParam(r, "height", asciicastDefaultHeight)
+	if err != nil {
+		renderError(rw, r, newBadRequestError(err.Error()))
+		return
+	}
+	if exists, err := s.hub.FeedExists(r.Context(), id); err != nil {
+		renderError(rw, r, err)
+		return
+	} else if !exists {
+		renderError(rw, r, newNotFoundError(fmt.Sprintf("Feed %s does not exist", id)))
+		return
+	}
+	if !s.requireFeedAccess(rw, r, id) {
+		return
+	}
+	entries, err := s.hub.GetEntries(r.Context(), id)
+	if err != nil {
+		renderError(rw, r, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/x-asciicast")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".cast"))
+	if err := writeAsciicast(rw, id, entries, width, height); err != nil {
+		log.Printf("Failed to write asciicast: %v", err)
+		return
+	}
+	observeServedEntries("asciicast", entries...)
 }
 
-func (s HTTPServer) handleWebsocket(rw http.ResponseWriter, r *http.Request) {
+func (s *HTTPServer) handleWebsocket(rw http.ResponseWriter, r *http.Request) {
+	s.peers.Add(1)
+	defer s.peers.Done()
 	conn, err := s.wsUpgrader.Upgrade(rw, r, nil)
 	if err != nil {
 		renderError(rw, r, err)
 		return
 	}
+	// Peers which never send the feed ID must not hold up the server's shutdown
+	conn.SetReadLimit(maxReadBytes)
+	conn.SetReadDeadline(time.Now().Add(pongDeadline))
 	msgType, msg, err := conn.ReadMessage()
 	if err != nil {
 		return
@@ -173,6 +297,13 @@ func (s HTTPServer) handleWebsocket(rw http.ResponseWriter, r *http.Request) {
 	}
 	ctx := r.Context()
 	feedID := string(msg)
+	lastID := r.URL.Query().Get(ws.ResumeParam)
+	replay := r.URL.Query().Get(ws.ReplayParam) != ""
+	replayOpts, err := parseReplayOptions(r)
+	if err != nil {
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, err.Error()))
+		return
+	}
 	if exists, err := s.hub.FeedExists(ctx, feedID); err != nil {
 		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "Internal error"))
 		return
@@ -180,6 +311,25 @@ func (s HTTPServer) handleWebsocket(rw http.ResponseWriter, r *http.Request) {
 		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(ws.CloseNotFound, "Feed not found"))
 		return
 	}
+	if ok, err := s.canViewFeed(r, feedID); err != nil {
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "Internal error"))
+		return
+	} else if !ok {
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(ws.CloseUnauthorized, "Password required"))
+		return
+	}
+	var head *Entry // Partial entry in which a tail view starts
+	if v := r.URL.Query().Get(ws.TailParam); v != "" && lastID == "" && !replay {
+		tail, err := strconv.Atoi(v)
+		if err != nil || tail < 0 {
+			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, "invalid tail parameter"))
+			return
+		}
+		if lastID, head, err = s.tailStart(ctx, feedID, tail); err != nil {
+			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "Internal error"))
+			return
+		}
+	}
 	if feedID != "example" {
 		if canAdd := s.rateLimiter.TryAddPeer(ctx, feedID); !canAdd {
 			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(ws.CloseTooManyPeers, "Too many concurrent peers for this feed"))
@@ -187,19 +337,120 @@ func (s HTTPServer) handleWebsocket(rw http.ResponseWriter, r *http.Request) {
 		}
 		defer s.rateLimiter.RemovePeer(ctx, feedID)
 	}
+	websocketPeersActive.Inc()
+	defer websocketPeersActive.Dec()
 
 	peer := &Peer{
 		conn: conn,
 		hub:  s.hub,
+		quit: s.quit,
+	}
+	if head != nil {
+		peer.conn.SetWriteDeadline(time.Now().Add(writeDeadline))
+		if err := peer.conn.WriteMessage(websocket.BinaryMessage, encodeEntry(*head)); err != nil {
+			return
+		}
+		observeServedEntries("websocket", *head)
 	}
+	// Either loop returning ends the other, e.g. so that the read loop stops waiting
+	// to hand replay controls to a replay loop which has already returned.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	g := new(errgroup.Group)
-	g.Go(func() error { return peer.readLoop(ctx) })
-	g.Go(func() error { return peer.writeLoop(ctx, feedID) })
+	if replay {
+		peer.controls = make(chan replayControl)
+		g.Go(func() error {
+			defer cancel()
+			return peer.replayLoop(ctx, feedID, replayOpts)
+		})
+	} else {
+		g.Go(func() error {
+			defer cancel()
+			return peer.writeLoop(ctx, feedID, lastID)
+		})
+	}
+	g.Go(func() error {
+		defer cancel()
+		return peer.readLoop(ctx)
+	})
 	if err := g.Wait(); err != nil {
 		log.Printf("Internal error: %v", err)
 	}
 }
 
+// tailStart locates the start of the feed's last 'lines' lines, where a final line without
+// a trailing newline counts as a line. Returns the ID of the entry after which to start
+// listening, which is empty if the feed has no more lines, and the entry in which the first
+// line starts if it does not start at the entry's beginning, trimmed to the line's start.
+func (s *HTTPServer) tailStart(ctx context.Context, id string, lines int) (string, *Entry, error) {
+	entries, err := s.hub.GetEntries(ctx, id)
+	if err != nil || len(entries) == 0 {
+		return "", nil, err
+	}
+	last := entries[len(entries)-1]
+	newlines := lines
+	if len(last.Data) > 0 && last.Data[len(last.Data)-1] == '\n' {
+		// The final newline terminates the last line rather than starting a new one
+		newlines++
+	}
+	if newlines == 0 {
+		return last.ID, nil, nil
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		data := entries[i].Data
+		for j := len(data) - 1; j >= 0; j-- {
+			if data[j] != '\n' {
+				continue
+			}
+			if newlines--; newlines > 0 {
+				continue
+			}
+			if j == len(data)-1 {
+				return entries[i].ID, nil, nil
+			}
+			head := entries[i]
+			head.Data = data[j+1:]
+			return entries[i].ID, &head, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// parseReplayOptions from the websocket handshake's query parameters.
+func parseReplayOptions(r *http.Request) (replayOptions, error) {
+	opts := replayOptions{speed: 1}
+	query := r.URL.Query()
+	if v := query.Get(ws.SpeedParam); v != "" {
+		speed, err := strconv.ParseFloat(v, 64)
+		if err != nil || speed <= 0 || speed > maxReplaySpeed {
+			return opts, errors.New("invalid replay speed")
+		}
+		opts.speed = speed
+	}
+	if v := query.Get(ws.MaxIdleParam); v != "" {
+		seconds, err := strconv.ParseFloat(v, 64)
+		if err != nil || seconds < 0 {
+			return opts, errors.New("invalid replay idle limit")
+		}
+		opts.maxIdle = time.Duration(seconds * float64(time.Second))
+	}
+	return opts, nil
+}
+
+// positiveIntParam returns the named query parameter as a positive integer,
+// or the fallback value if the parameter is not set.
+func positiveIntParam(r *http.Request, name string, fallback int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s parameter: must be a positive integer", name)
+	}
+	return n, nil
+}
+
 func withRecovery(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -208,7 +459,7 @@ func withRecovery(next http.Handler) http.Handler {
 				return
 			}
 			// TODO Unravel stack trace
-			log.Printf("panic: %v", err)
+			log.Printf("panic: %v (client %s)", err, logClientIP(r))
 			http.Error(rw, "An error occurred on our end", http.StatusInternalServerError)
 		}()
 		next.ServeHTTP(rw, r)
@@ -226,7 +477,7 @@ func withRequestID(next http.Handler) http.Handler {
 }
 
 func renderError(rw http.ResponseWriter, r *http.Request, err any) {
-	log.Printf("Rendering error: %v", err)
+	log.Printf("Rendering error: %v (client %s)", err, logClientIP(r))
 	data := renderableError{
 		StatusCode:  http.StatusInternalServerError,
 		Title:       "Something went wrong",
@@ -272,3 +523,13 @@ func newNotFoundError(details string) renderableError {
 		Details:     details,
 	}
 }
+
+func newUnauthorizedError(details string) renderableError {
+	return renderableError{
+		StatusCode:  http.StatusUnauthorized,
+		Title:       "Unauthorized",
+		Name:        "Password required",
+		Description: "The requested resource is protected by a password",
+		Details:     details,
+	}
+}
@@ -0,0 +1,55 @@
+package nacre
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTailStart(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		lines  int
+		want   string
+	}{
+		{name: "empty feed", chunks: nil, lines: 2, want: ""},
+		{name: "fewer lines than requested", chunks: []string{"a\n", "b\n"}, lines: 5, want: "a\nb\n"},
+		{name: "entry per line", chunks: []string{"a\n", "b\n", "c\n"}, lines: 2, want: "b\nc\n"},
+		{name: "lines within an entry", chunks: []string{"a\nb\nc\n"}, lines: 2, want: "b\nc\n"},
+		{name: "line spanning entries", chunks: []string{"a\nb", "b\nc", "c\n"}, lines: 2, want: "bb\ncc\n"},
+		{name: "unterminated last line", chunks: []string{"a\nb\n", "$ "}, lines: 2, want: "b\n$ "},
+		{name: "zero lines", chunks: []string{"a\n", "b\n"}, lines: 0, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			hub := NewMemoryHub(1024*1024, time.Hour)
+			defer hub.Close()
+			for _, chunk := range tt.chunks {
+				if err := hub.Push(ctx, "feed", []byte(chunk)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := &HTTPServer{hub: hub}
+			startID, head, err := s.tailStart(ctx, "feed", tt.lines)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := hub.GetEntriesAfter(ctx, "feed", startID, len(tt.chunks)+1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if head != nil {
+				got = string(head.Data)
+			}
+			for _, entry := range entries {
+				got += string(entry.Data)
+			}
+			if got != tt.want {
+				t.Errorf("tailStart(%d) shows %q, want %q", tt.lines, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package nacre
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Response headers describing the feed which an HTTP producer streams to.
+const (
+	headerFeedID     = "X-Nacre-Feed-Id"
+	headerFeedURL    = "X-Nacre-Feed-Url"
+	headerOwnerToken = "X-Nacre-Owner-Token"
+)
+
+// headerPassword carries the password which protects a feed from viewers. Producers
+// set it when streaming to /ingest, and viewers exchange it for the feed's view key.
+const headerPassword = "X-Nacre-Password"
+
+// handleIngest streams the request body to a feed, for producers which cannot reach the
+// TCP listener but can make HTTP requests, e.g. `make test | curl -T - https://nacre.dev/ingest`.
+//
+// Feeds are configured with the handshake options as query parameters, except for the
+// owner token and the password, which are read from the X-Nacre-Owner-Token and
+// X-Nacre-Password headers to keep them out of logs.
+// The feed's URL is returned in the response headers as soon as the feed is opened,
+// while the request body is still streaming.
+func (s *HTTPServer) handleIngest(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		rw.Header().Set("Allow", "PUT, POST")
+		http.Error(rw, "nacre: method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// The request's context is cancelled as soon as the client goes away,
+	// but the feed must still be marked as disconnected afterwards.
+	ctx := context.WithoutCancel(r.Context())
+
+	clientIP, err := requestClientIP(r)
+	if err != nil {
+		http.Error(rw, "nacre: internal error", http.StatusInternalServerError)
+		return
+	}
+	if canAdd := s.ingester.rateLimiter.TryAddClient(ctx, clientIP); !canAdd {
+		http.Error(rw, "nacre: too many concurrent feeds from your IP", http.StatusTooManyRequests)
+		return
+	}
+	defer s.ingester.rateLimiter.RemoveClient(ctx, clientIP)
+
+	query := r.URL.Query()
+	hs := handshake{
+		name:  query.Get(handshakeOptionName),
+		feed:  query.Get(handshakeOptionFeed),
+		token: r.Header.Get(headerOwnerToken),
+
+		password: r.Header.Get(headerPassword),
+	}
+	if err := hs.validate(); err != nil {
+		http.Error(rw, fmt.Sprintf("nacre: %s", err), http.StatusBadRequest)
+		return
+	}
+	sid, token, msg, err := s.ingester.openFeed(ctx, hs)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errFeedNameTaken):
+			status = http.StatusConflict
+		case errors.Is(err, errInvalidOwnerToken):
+			status = http.StatusForbidden
+		}
+		http.Error(rw, fmt.Sprintf("nacre: %s", openFeedError(err, hs)), status)
+		return
+	}
+
+	// By default, HTTP/1.1 request bodies can no longer be read once the response is
+	// written to. HTTP/2 requests are always full duplex, hence the error is ignored.
+	rc := http.NewResponseController(rw)
+	_ = rc.EnableFullDuplex()
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set(headerFeedID, sid)
+	rw.Header().Set(headerFeedURL, liveFeedURL(s.ingester.baseURL, sid))
+	if token != "" {
+		rw.Header().Set(headerOwnerToken, token)
+	}
+	if r.Header.Get("Expect") == "100-continue" {
+		// Clients like curl wait for the go-ahead before streaming the body,
+		// which is otherwise only sent on the first read of the body.
+		rw.WriteHeader(http.StatusContinue)
+	}
+	rw.WriteHeader(http.StatusOK)
+	notices := &flushWriter{rw: rw, rc: rc}
+	if _, err := notices.Write([]byte(msg)); err != nil {
+		log.Printf("error: rw.Write: %s\n", err.Error())
+	}
+
+	// Unblock the pending body read when the server shuts down, or once the producer
+	// has been idle for too long
+	stream := &idleReader{reader: r.Body, setReadDeadline: rc.SetReadDeadline, timeout: clientConnectionReadTimeout, quit: s.quit}
+	done := make(chan empty)
+	defer close(done)
+	go func() {
+		select {
+		case <-s.quit:
+			_ = rc.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	httpProducersActive.Inc()
+	defer httpProducersActive.Dec()
+	s.ingester.ingest(ctx, s.quit, sid, clientIP, stream, notices)
+
+	select {
+	case <-s.quit:
+		notices.Write([]byte("\nnacre: server shutting down\n"))
+	default:
+	}
+}
+
+// flushWriter flushes every write to the client, so that notices arrive while
+// the request is still streaming.
+type flushWriter struct {
+	rw http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.rw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.rc.Flush()
+}
@@ -0,0 +1,172 @@
+package nacre
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/johanmickos/nacre/internal/ws"
+)
+
+const publisherCloseTimeout = time.Second * 1
+
+// handlePublish upgrades the request to a websocket over which a producer publishes a feed,
+// for web-based tools and sandboxed environments which cannot open raw TCP connections.
+//
+// Once the feed is opened, the publisher receives a ws.PublishEvent describing it, after
+// which every binary or text message it sends is pushed to the feed. Closing the websocket
+// normally ends the feed, while other disconnects leave it open for reattaching.
+func (s *HTTPServer) handlePublish(rw http.ResponseWriter, r *http.Request) {
+	s.peers.Add(1)
+	defer s.peers.Done()
+	conn, err := s.publishUpgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		renderError(rw, r, err)
+		return
+	}
+	defer conn.Close()
+	closeWith := func(code int, text string) {
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+	}
+	// The request's context is cancelled once the hijacked connection is closed,
+	// but the feed must still be marked as disconnected afterwards.
+	ctx := context.WithoutCancel(r.Context())
+
+	clientIP, err := requestClientIP(r)
+	if err != nil {
+		closeWith(websocket.CloseInternalServerErr, "Internal error")
+		return
+	}
+	if canAdd := s.ingester.rateLimiter.TryAddClient(ctx, clientIP); !canAdd {
+		closeWith(ws.CloseTooManyFeeds, "Too many concurrent feeds from your IP")
+		return
+	}
+	defer s.ingester.rateLimiter.RemoveClient(ctx, clientIP)
+
+	query := r.URL.Query()
+	hs := handshake{
+		name:  query.Get(ws.NameParam),
+		feed:  query.Get(ws.FeedParam),
+		token: query.Get(ws.TokenParam),
+
+		password: query.Get(ws.PasswordParam),
+	}
+	if err := hs.validate(); err != nil {
+		closeWith(websocket.CloseUnsupportedData, err.Error())
+		return
+	}
+	sid, token, _, err := s.ingester.openFeed(ctx, hs)
+	if err != nil {
+		code := websocket.CloseInternalServerErr
+		switch {
+		case errors.Is(err, errFeedNameTaken):
+			code = ws.CloseFeedNameTaken
+		case errors.Is(err, errInvalidOwnerToken):
+			code = ws.CloseInvalidOwnerToken
+		}
+		closeWith(code, openFeedError(err, hs))
+		return
+	}
+	err = conn.WriteJSON(ws.PublishEvent{
+		Type:       ws.PublishEventFeed,
+		FeedID:     sid,
+		FeedURL:    liveFeedURL(s.ingester.baseURL, sid),
+		OwnerToken: token,
+	})
+	if err != nil {
+		log.Printf("error: conn.WriteJSON: %s\n", err.Error())
+		s.hub.ClientDisconnected(ctx, sid)
+		return
+	}
+
+	// Publishers which stop answering pings are disconnected like viewers are
+	conn.SetReadDeadline(time.Now().Add(pongDeadline))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongDeadline))
+		return nil
+	})
+
+	// Ping the publisher meanwhile, and close the connection to unblock the pending read
+	// when the server shuts down
+	done := make(chan empty)
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.quit:
+				_ = conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server shutting down"),
+					time.Now().Add(publisherCloseTimeout),
+				)
+				conn.Close()
+				return
+			case <-ticker.C:
+				// Unlike other writes, control messages may be written concurrently
+				_ = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeDeadline))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	websocketProducersActive.Inc()
+	defer websocketProducersActive.Dec()
+	s.ingester.ingest(ctx, s.quit, sid, clientIP, &publisherStream{conn: conn}, &publisherNotices{conn: conn})
+	closeWith(websocket.CloseNormalClosure, "")
+}
+
+// publisherStream reads the publisher's messages as one continuous data stream.
+type publisherStream struct {
+	conn    *websocket.Conn
+	message io.Reader
+}
+
+func (p *publisherStream) Read(buf []byte) (int, error) {
+	for {
+		if p.message == nil {
+			_, message, err := p.conn.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			// Publishers which are sending data are alive, even if their pongs are delayed
+			p.conn.SetReadDeadline(time.Now().Add(pongDeadline))
+			p.message = message
+		}
+		n, err := p.message.Read(buf)
+		if errors.Is(err, io.EOF) {
+			p.message = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// publisherNotices sends the ingester's notices to the publisher as notice events.
+type publisherNotices struct {
+	conn *websocket.Conn
+}
+
+func (p *publisherNotices) Write(notice []byte) (int, error) {
+	event := ws.PublishEvent{
+		Type:    ws.PublishEventNotice,
+		Message: strings.TrimSpace(string(notice)),
+	}
+	if err := p.conn.WriteJSON(event); err != nil {
+		return 0, err
+	}
+	return len(notice), nil
+}
@@ -0,0 +1,133 @@
+package nacre
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const sseHeartbeatPeriod = time.Second * 15
+
+// Server-sent event types.
+const (
+	sseEventEntry     = "entry"
+	sseEventTruncated = "truncated"
+	sseEventEnd       = "end"
+)
+
+// handleEvents streams the feed's entries as server-sent events, for clients which cannot
+// use websockets. Each entry is sent as an 'entry' event carrying the entry's JSON
+// representation, with the entry's ID as the event ID so that reconnecting clients resume
+// after the last entry they received through the Last-Event-ID header.
+//
+// Evicted entries are signalled by a 'truncated' event, and an 'end' event is sent once
+// the feed's client disconnects, after which the stream is closed.
+func (s *HTTPServer) handleEvents(rw http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		writeAPIError(rw, r, fmt.Errorf("streaming unsupported by %T", rw))
+		return
+	}
+	encoding, err := apiEncodingParam(r)
+	if err != nil {
+		writeAPIError(rw, r, newBadRequestError(err.Error()))
+		return
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		// Allows resuming with clients that cannot set headers, such as EventSource
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	if exists, err := s.hub.FeedExists(ctx, id); err != nil {
+		writeAPIError(rw, r, err)
+		return
+	} else if !exists {
+		writeAPIError(rw, r, newNotFoundError(fmt.Sprintf("Feed %s does not exist", id)))
+		return
+	}
+	if !s.requireAPIFeedAccess(rw, r, id) {
+		return
+	}
+	if id != "example" {
+		if canAdd := s.rateLimiter.TryAddPeer(ctx, id); !canAdd {
+			writeAPIError(rw, r, renderableError{
+				StatusCode: http.StatusTooManyRequests,
+				Details:    "Too many concurrent peers for this feed",
+			})
+			return
+		}
+		// The request's context is already cancelled once the client goes away,
+		// but the peer must still be released afterwards.
+		defer s.rateLimiter.RemovePeer(context.WithoutCancel(ctx), id)
+	}
+	entries, err := s.hub.Listen(ctx, id, lastID)
+	if err != nil {
+		writeAPIError(rw, r, err)
+		return
+	}
+	ssePeersActive.Inc()
+	defer ssePeersActive.Dec()
+
+	header := rw.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no") // Disable response buffering by nginx
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatPeriod)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.quit:
+			// Clients reconnect to another instance and resume through Last-Event-ID
+			return
+		case entry, ok := <-entries:
+			switch {
+			case !ok:
+				err = writeEvent(rw, "", sseEventEnd, struct{}{})
+			case entry.Truncated:
+				err = writeEvent(rw, "", sseEventTruncated, struct{}{})
+			default:
+				err = writeEvent(rw, entry.ID, sseEventEntry, newAPIEntry(entry, encoding))
+				observeServedEntries("sse", entry)
+			}
+			if !ok {
+				flusher.Flush()
+				return
+			}
+		case <-heartbeat.C:
+			// Comments keep idle connections from being closed by proxies
+			_, err = io.WriteString(rw, ": heartbeat\n\n")
+		}
+		if err != nil {
+			log.Printf("Failed to write event: %v", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes a single server-sent event with a JSON-encoded payload.
+// Events without an ID leave the client's last event ID unchanged.
+func writeEvent(w io.Writer, id string, event string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
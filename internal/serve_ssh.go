@@ -0,0 +1,354 @@
+package nacre
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sshHandshakeTimeout = time.Second * 10
+	// sshIdleTimeout closes connections which have had no running session for this long.
+	sshIdleTimeout = time.Second * 10
+
+	// sshPermFingerprint is the permissions extension carrying the fingerprint
+	// of the public key which the client authenticated with.
+	sshPermFingerprint = "nacre-fingerprint"
+)
+
+// SSHServer handles nacre's SSH clients, for producers which can reach an SSH port
+// but not arbitrary TCP ports:
+//
+//	make test | ssh nacre.dev
+//	make test | ssh nacre.dev name=nightly-build
+//
+// The command requested by the client is parsed as handshake options. Clients may
+// authenticate with any public key, whose fingerprint owns the feeds they create so
+// that they can reattach with the same key. Concurrent feeds are limited by the key's
+// fingerprint. Keys are free to generate, so concurrent connections and bandwidth are
+// additionally limited by the client's IP.
+type SSHServer struct {
+	listener  net.Listener
+	config    *ssh.ServerConfig
+	quit      chan empty
+	quitOnce  sync.Once
+	accepting int32 // Set to 1 while the server is accepting connections
+	wg        sync.WaitGroup
+	ingester  *ingester
+	// Sources which must prefix their connections with a PROXY protocol header.
+	// See TCPServer.
+	proxyProtocol CIDRs
+
+	address string
+}
+
+// NewSSHServer returns a stoppable SSH server listening on the provided address,
+// identifying itself with the host key read from the provided file.
+func NewSSHServer(address string, hostKeyFile string, proxyProtocol CIDRs, httpAddress string, hub Hub, rateLimiter RateLimiter, bandwidth BandwidthLimiter) (*SSHServer, error) {
+	pem, err := os.ReadFile(hostKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH host key: %w", err)
+	}
+	hostKey, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH host key: %w", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			// Any key is accepted. The permissions of the key which the client
+			// actually authenticates with are attached to the connection.
+			return &ssh.Permissions{
+				Extensions: map[string]string{sshPermFingerprint: ssh.FingerprintSHA256(key)},
+			}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &SSHServer{
+		listener:      listener,
+		config:        config,
+		quit:          make(chan empty),
+		wg:            sync.WaitGroup{},
+		ingester:      newIngester(httpAddress, hub, rateLimiter, bandwidth),
+		proxyProtocol: proxyProtocol,
+		address:       address,
+	}, nil
+}
+
+// Serve incoming SSH connections and handle them in new goroutines
+// until the server is shut down.
+func (s *SSHServer) Serve(ctx context.Context) {
+	s.wg.Add(1)
+	defer s.wg.Done()
+	atomic.StoreInt32(&s.accepting, 1)
+	defer atomic.StoreInt32(&s.accepting, 0)
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+			log.Printf("error: listener.Accept: %s\n", err.Error())
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if s.proxyProtocol.ContainsAddr(conn.RemoteAddr()) {
+				proxied, err := readProxyHeader(conn)
+				if err != nil {
+					log.Printf("error: connection from %s: %s\n", conn.RemoteAddr(), err.Error())
+					conn.Close()
+					return
+				}
+				conn = proxied
+			}
+			s.handle(ctx, conn)
+		}()
+	}
+}
+
+// Accepting returns true if the server is currently accepting new connections.
+func (s *SSHServer) Accepting() bool {
+	return atomic.LoadInt32(&s.accepting) == 1 && !s.shuttingDown()
+}
+
+// Shutdown stops accepting new connections, notifies connected clients that the server
+// is shutting down, and waits for their handlers to mark the feeds as disconnected.
+// Returns the context's error if the handlers do not finish before it is done.
+func (s *SSHServer) Shutdown(ctx context.Context) error {
+	s.quitOnce.Do(func() { close(s.quit) })
+	if err := s.listener.Close(); err != nil {
+		log.Printf("error: listener.Close: %s\n", err.Error())
+	}
+	done := make(chan empty)
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *SSHServer) shuttingDown() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// handle the SSH connection by serving each of its sessions as a separate feed.
+func (s *SSHServer) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	// Connections are counted before the handshake, which is costly for the server
+	if canAdd := s.ingester.rateLimiter.TryAddClient(ctx, clientIP); !canAdd {
+		return
+	}
+	defer s.ingester.rateLimiter.RemoveClient(ctx, clientIP)
+
+	conn.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+	sconn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	defer sconn.Close()
+	go ssh.DiscardRequests(requests)
+
+	// Sessions notify their clients when the server shuts down. Closing the connection
+	// afterwards ends the sessions which have not requested a command yet.
+	done := make(chan empty)
+	defer close(done)
+	go func() {
+		select {
+		case <-s.quit:
+			timer := time.NewTimer(clientShutdownWriteTimeout)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-done:
+			}
+			sconn.Close()
+		case <-done:
+		}
+	}()
+
+	idle := newIdleConnTimer(sshIdleTimeout, func() { sconn.Close() })
+	defer idle.stop()
+
+	fingerprint := sconn.Permissions.Extensions[sshPermFingerprint]
+	var sessions sync.WaitGroup
+	defer sessions.Wait()
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			defer channel.Close()
+			command, ok := awaitSessionCommand(requests)
+			if !ok {
+				return
+			}
+			idle.sessionStarted()
+			defer idle.sessionEnded()
+			s.handleSession(ctx, clientIP, fingerprint, command, channel, requests)
+		}()
+	}
+}
+
+// handleSession pushes the input of the session, whose client requested the command,
+// to the feed, writing nacre's messages to the session's stderr. The client's key
+// fingerprint identifies the owner of its feeds and limits its concurrent feeds,
+// while bandwidth is limited by the client's IP.
+func (s *SSHServer) handleSession(ctx context.Context, clientIP string, fingerprint string, command string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	go func() {
+		// Decline any further requests, such as window size changes
+		for req := range requests {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+	stderr := channel.Stderr()
+	exitStatus := uint32(1)
+	defer func() {
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{exitStatus}))
+	}()
+
+	hs, err := parseHandshake(handshakePrefix+command, fingerprint)
+	if err != nil {
+		fmt.Fprintf(stderr, "nacre: %s\n", err)
+		return
+	}
+	if canAdd := s.ingester.rateLimiter.TryAddClient(ctx, fingerprint); !canAdd {
+		fmt.Fprintf(stderr, "nacre: too many concurrent feeds from your SSH key\n")
+		return
+	}
+	defer s.ingester.rateLimiter.RemoveClient(ctx, fingerprint)
+
+	sid, _, msg, err := s.ingester.openFeed(ctx, hs)
+	if err != nil {
+		fmt.Fprintf(stderr, "nacre: %s\n", openFeedError(err, hs))
+		return
+	}
+	if _, err := stderr.Write([]byte(msg)); err != nil {
+		s.ingester.hub.ClientDisconnected(ctx, sid)
+		return
+	}
+
+	// Closing the channel unblocks the pending read when the server shuts down
+	done := make(chan empty)
+	defer close(done)
+	go func() {
+		select {
+		case <-s.quit:
+			stderr.Write([]byte("\nnacre: server shutting down\n"))
+			channel.Close()
+		case <-done:
+		}
+	}()
+
+	sshProducersActive.Inc()
+	defer sshProducersActive.Dec()
+	s.ingester.ingest(ctx, s.quit, sid, clientIP, channel, stderr)
+	exitStatus = 0
+}
+
+// awaitSessionCommand replies to the session's requests until the client requests a
+// command or shell, returning the requested command. Returns false if the session
+// ends before then.
+func awaitSessionCommand(requests <-chan *ssh.Request) (string, bool) {
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			return strings.TrimSpace(payload.Command), true
+		case "shell":
+			req.Reply(true, nil)
+			return "", true
+		case "env":
+			// Accepted and ignored, as clients commonly forward their locale
+			req.Reply(true, nil)
+		default:
+			// Notably declines pseudo-terminals, whose line discipline would mangle the data
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+	return "", false
+}
+
+// idleConnTimer closes an SSH connection once it has had no running session for a while,
+// so that authenticated clients cannot hold on to connections without streaming.
+type idleConnTimer struct {
+	mu      sync.Mutex
+	running int
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func newIdleConnTimer(timeout time.Duration, onIdle func()) *idleConnTimer {
+	return &idleConnTimer{
+		timer:   time.AfterFunc(timeout, onIdle),
+		timeout: timeout,
+	}
+}
+
+func (t *idleConnTimer) sessionStarted() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running++
+	t.timer.Stop()
+}
+
+func (t *idleConnTimer) sessionEnded() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running--
+	if t.running == 0 {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleConnTimer) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timer.Stop()
+}
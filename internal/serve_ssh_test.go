@@ -0,0 +1,201 @@
+package nacre
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestSSHSigner returns a signer for a new ed25519 key.
+func newTestSSHSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// startTestSSHServer serves an SSH listener backed by in-memory implementations,
+// returning the listener's address.
+func startTestSSHServer(t *testing.T) string {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(hostKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKeyFile := filepath.Join(t.TempDir(), "host_key")
+	if err := os.WriteFile(hostKeyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hub := NewMemoryHub(1024*1024, time.Hour)
+	server, err := NewSSHServer(
+		"127.0.0.1:0", hostKeyFile, nil, "http://localhost:8080",
+		hub, NewInMemoryRateLimiter(), NewInMemoryBandwidthLimiter(1024*1024, 1024*1024, 0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(context.Background())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		server.Shutdown(ctx)
+		hub.Close()
+	})
+	return server.listener.Addr().String()
+}
+
+func dialTestSSHServer(address string, signer ssh.Signer) (*ssh.Client, error) {
+	return ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "nacre",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         time.Second * 5,
+	})
+}
+
+// startTestSSHSession starts a session which streams to a new feed, returning the first
+// line which the server wrote to the session's stderr.
+func startTestSSHSession(t *testing.T, client *ssh.Client) string {
+	t.Helper()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	// Keeping stdin open keeps the feed streaming
+	if _, err := session.StdinPipe(); err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(stderr).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func TestSSHServerFeedsPerKey(t *testing.T) {
+	address := startTestSSHServer(t)
+	client, err := dialTestSSHServer(address, newTestSSHSigner(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < defaultMaxClientsPerIP; i++ {
+		if line := startTestSSHSession(t, client); !strings.HasPrefix(line, "Connected to nacre") {
+			t.Fatalf("session %d: got %q, want a greeting", i, line)
+		}
+	}
+	if line := startTestSSHSession(t, client); !strings.Contains(line, "too many concurrent feeds from your SSH key") {
+		t.Errorf("got %q, want the feed limit to be reached", line)
+	}
+
+	// Other keys have feeds of their own, even from the same IP
+	other, err := dialTestSSHServer(address, newTestSSHSigner(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if line := startTestSSHSession(t, other); !strings.HasPrefix(line, "Connected to nacre") {
+		t.Errorf("got %q from another key, want a greeting", line)
+	}
+}
+
+func TestSSHServerConnectionsPerIP(t *testing.T) {
+	address := startTestSSHServer(t)
+	clients := make([]*ssh.Client, defaultMaxClientsPerIP)
+	for i := range clients {
+		client, err := dialTestSSHServer(address, newTestSSHSigner(t))
+		if err != nil {
+			t.Fatalf("connection %d: %s", i, err)
+		}
+		defer client.Close()
+		clients[i] = client
+	}
+	if client, err := dialTestSSHServer(address, newTestSSHSigner(t)); err == nil {
+		client.Close()
+		t.Fatal("connected above the limit")
+	}
+
+	// The server frees the slot once it notices that the connection closed
+	clients[0].Close()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		client, err := dialTestSSHServer(address, newTestSSHSigner(t))
+		if err == nil {
+			client.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("failed to connect after closing a connection: %s", err)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func TestIdleConnTimer(t *testing.T) {
+	timeout := time.Millisecond * 100
+	tests := []struct {
+		name     string
+		sessions func(timer *idleConnTimer)
+		wantIdle bool
+	}{
+		{name: "no sessions", sessions: func(timer *idleConnTimer) {}, wantIdle: true},
+		{name: "running session", sessions: func(timer *idleConnTimer) { timer.sessionStarted() }, wantIdle: false},
+		{
+			name: "ended session",
+			sessions: func(timer *idleConnTimer) {
+				timer.sessionStarted()
+				timer.sessionEnded()
+			},
+			wantIdle: true,
+		},
+		{
+			name: "one of two sessions ended",
+			sessions: func(timer *idleConnTimer) {
+				timer.sessionStarted()
+				timer.sessionStarted()
+				timer.sessionEnded()
+			},
+			wantIdle: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var idle int32
+			timer := newIdleConnTimer(timeout, func() { atomic.StoreInt32(&idle, 1) })
+			defer timer.stop()
+			tt.sessions(timer)
+			time.Sleep(timeout * 3)
+			if got := atomic.LoadInt32(&idle) == 1; got != tt.wantIdle {
+				t.Errorf("idle = %t, want %t", got, tt.wantIdle)
+			}
+		})
+	}
+}
@@ -1,70 +1,217 @@
 package nacre
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	clientConnectedHeartbeat    = time.Second * 2
+	// clientConnectionReadTimeout disconnects producers which sent no data for this long.
 	clientConnectionReadTimeout = time.Minute * 1
+	clientShutdownWriteTimeout  = time.Second * 1
+	// tlsHandshakeTimeout bounds the TLS handshake, which completes before the much
+	// shorter handshake line timeout applies.
+	tlsHandshakeTimeout = time.Second * 10
 )
 
 // TCPServer handles nacre's TCP clients and their data streams.
 type TCPServer struct {
-	listener    net.Listener
-	quit        chan struct{}
-	wg          sync.WaitGroup
-	hub         Hub
-	rateLimiter RateLimiter
+	listener  net.Listener
+	quit      chan empty
+	quitOnce  sync.Once
+	accepting int32 // Set to 1 while the server is accepting connections
+	wg        sync.WaitGroup
+	ingester  *ingester
+	tlsConfig *tls.Config // Encrypts accepted connections if set
+	// Sources which must prefix their connections with a PROXY protocol header,
+	// such as a load balancer. Their connections are attributed to the client
+	// address from the header.
+	proxyProtocol CIDRs
+
+	mu    sync.Mutex
+	conns map[net.Conn]empty
 
 	address string
-	baseURL string
-	bufsize int
 }
 
 // NewTCPServer returns a stoppable TCP server listening on the provided address.
-func NewTCPServer(address string, httpAddress string, hub Hub, rateLimiter RateLimiter) (*TCPServer, error) {
-	server := &TCPServer{
-		quit:        make(chan struct{}),
-		hub:         hub,
-		rateLimiter: rateLimiter,
-		wg:          sync.WaitGroup{},
-		address:     address,
-		baseURL:     httpAddress,
-		bufsize:     1024 * 2,
-	}
+func NewTCPServer(address string, proxyProtocol CIDRs, httpAddress string, hub Hub, rateLimiter RateLimiter, bandwidth BandwidthLimiter) (*TCPServer, error) {
+	return newTCPServer(address, nil, proxyProtocol, httpAddress, hub, rateLimiter, bandwidth)
+}
+
+// NewTLSServer returns a stoppable TCP server listening for TLS-encrypted connections
+// on the provided address.
+func NewTLSServer(address string, tlsConfig *tls.Config, proxyProtocol CIDRs, httpAddress string, hub Hub, rateLimiter RateLimiter, bandwidth BandwidthLimiter) (*TCPServer, error) {
+	return newTCPServer(address, tlsConfig, proxyProtocol, httpAddress, hub, rateLimiter, bandwidth)
+}
+
+func newTCPServer(address string, tlsConfig *tls.Config, proxyProtocol CIDRs, httpAddress string, hub Hub, rateLimiter RateLimiter, bandwidth BandwidthLimiter) (*TCPServer, error) {
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return nil, err
 	}
-	server.listener = listener
-	return server, nil
+	return &TCPServer{
+		listener:      listener,
+		quit:          make(chan empty),
+		wg:            sync.WaitGroup{},
+		ingester:      newIngester(httpAddress, hub, rateLimiter, bandwidth),
+		tlsConfig:     tlsConfig,
+		proxyProtocol: proxyProtocol,
+		mu:            sync.Mutex{},
+		conns:         make(map[net.Conn]empty),
+		address:       address,
+	}, nil
 }
 
-// Serve incoming TCP connections and handle them in new goroutines.
+// Serve incoming TCP connections and handle them in new goroutines
+// until the server is shut down.
 func (s *TCPServer) Serve(ctx context.Context) {
 	s.wg.Add(1)
 	defer s.wg.Done()
+	atomic.StoreInt32(&s.accepting, 1)
+	defer atomic.StoreInt32(&s.accepting, 0)
 
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
 			log.Printf("error: listener.Accept: %s\n", err.Error())
 			continue
 		}
+		if !s.trackConn(conn) {
+			conn.Close()
+			return
+		}
 		s.wg.Add(1)
 		go func() {
 			defer s.wg.Done()
-			s.handle(ctx, conn)
+			defer conn.Close()
+			wrapped, err := s.wrapConn(ctx, conn)
+			if err != nil {
+				log.Printf("error: connection from %s: %s\n", conn.RemoteAddr(), err.Error())
+				s.untrackConn(conn)
+				return
+			}
+			defer s.untrackConn(wrapped)
+			s.handle(ctx, wrapped)
 		}()
 	}
 }
 
+// Accepting returns true if the server is currently accepting new connections.
+func (s *TCPServer) Accepting() bool {
+	return atomic.LoadInt32(&s.accepting) == 1 && !s.shuttingDown()
+}
+
+// Shutdown stops accepting new connections, notifies connected clients that the server
+// is shutting down, and waits for their handlers to mark the feeds as disconnected.
+// Returns the context's error if the handlers do not finish before it is done.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.quitOnce.Do(func() { close(s.quit) })
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	if err := s.listener.Close(); err != nil {
+		log.Printf("error: listener.Close: %s\n", err.Error())
+	}
+	for _, conn := range conns {
+		// Closing the connection unblocks the handler's pending read
+		conn.SetWriteDeadline(time.Now().Add(clientShutdownWriteTimeout))
+		conn.Write([]byte("\nnacre: server shutting down\n"))
+		conn.Close()
+	}
+
+	done := make(chan empty)
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trackConn registers the connection for shutdown notifications,
+// returning false if the server is already shutting down.
+func (s *TCPServer) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.quit:
+		return false
+	default:
+	}
+	s.conns[conn] = empty{}
+	return true
+}
+
+func (s *TCPServer) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// retrackConn replaces the tracked connection with the connection wrapping it, so
+// that shutdown notifications are written through any TLS layer.
+func (s *TCPServer) retrackConn(conn net.Conn, wrapped net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[conn]; ok {
+		delete(s.conns, conn)
+		s.conns[wrapped] = empty{}
+	}
+}
+
+// wrapConn reads the connection's PROXY protocol header if it comes from a trusted
+// proxy, and completes the TLS handshake if the server is configured to encrypt
+// connections. Both block, so this must not be called from the accepting goroutine.
+//
+// The TLS handshake must complete before the handshake line is read: tls.Conn keeps
+// the error of a handshake which was interrupted by the handshake line's short read
+// deadline, leaving slow clients' connections unusable.
+func (s *TCPServer) wrapConn(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	wrapped := conn
+	if s.proxyProtocol.ContainsAddr(conn.RemoteAddr()) {
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			return nil, err
+		}
+		wrapped = proxied
+	}
+	if s.tlsConfig != nil {
+		tlsConn := tls.Server(wrapped, s.tlsConfig)
+		handshakeCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+		err := tlsConn.HandshakeContext(handshakeCtx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("TLS handshake: %w", err)
+		}
+		wrapped = tlsConn
+	}
+	if wrapped != conn {
+		s.retrackConn(conn, wrapped)
+	}
+	return wrapped, nil
+}
+
 // handle the connection by reading incoming bytes and pushing them to
 // the Hub implementation.
 func (s *TCPServer) handle(ctx context.Context, conn net.Conn) {
@@ -75,14 +222,23 @@ func (s *TCPServer) handle(ctx context.Context, conn net.Conn) {
 		conn.Write([]byte("nacre: internal error"))
 		return
 	}
-	if canAdd := s.rateLimiter.TryAddClient(ctx, clientIP); !canAdd {
+	if canAdd := s.ingester.rateLimiter.TryAddClient(ctx, clientIP); !canAdd {
 		conn.Write([]byte("nacre: too many concurrent feeds from your IP\n"))
 		return
 	}
-	defer s.rateLimiter.RemoveClient(ctx, clientIP)
+	defer s.ingester.rateLimiter.RemoveClient(ctx, clientIP)
 
-	sid := NewRandString(defaultRandSrc, 6)
-	msg := fmt.Sprintf("Connected to nacre. Serving at: %s\n", liveFeedURL(s.baseURL, sid))
+	reader := bufio.NewReaderSize(conn, s.ingester.bufsize)
+	hs, err := readHandshake(conn, reader)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("nacre: %s\n", err)))
+		return
+	}
+	sid, _, msg, err := s.ingester.openFeed(ctx, hs)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("nacre: %s\n", openFeedError(err, hs))))
+		return
+	}
 	n, err := conn.Write([]byte(msg))
 	if err != nil {
 		log.Printf("error: conn.Write: %s\n", err.Error())
@@ -93,45 +249,18 @@ func (s *TCPServer) handle(ctx context.Context, conn net.Conn) {
 		return
 	}
 
-	heartbeatCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	defer s.hub.ClientDisconnected(ctx, sid)
-	go func(ctx context.Context) {
-		heartbeat := time.NewTicker(clientConnectedHeartbeat)
-		_ = s.hub.ClientConnected(ctx, sid)
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-s.quit:
-				return
-			case <-heartbeat.C:
-				_ = s.hub.ClientConnected(ctx, sid)
-			}
-		}
-	}(heartbeatCtx)
+	tcpProducersActive.Inc()
+	defer tcpProducersActive.Dec()
+	stream := &idleReader{reader: reader, setReadDeadline: conn.SetReadDeadline, timeout: clientConnectionReadTimeout}
+	s.ingester.ingest(ctx, s.quit, sid, clientIP, stream, conn)
+}
 
-	buf := make([]byte, s.bufsize) // NOTE: Could consider buffer pool to limit memory usage
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-s.quit:
-			return
-		default: // Continue serving client
-		}
-		// TODO Bandwidth quota per IP
-		nbytes, err := conn.Read(buf)
-		if err != nil {
-			return
-		}
-		if nbytes == 0 {
-			return
-		}
-		if err := s.hub.Push(ctx, sid, buf[0:nbytes]); err != nil {
-			log.Printf("Failed to push data: %s", err)
-			return
-		}
+func (s *TCPServer) shuttingDown() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -0,0 +1,102 @@
+package nacre
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTLSConfig returns a TLS config with a self-signed certificate for localhost.
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+// startTestTLSServer serves a TLS listener backed by in-memory implementations,
+// returning the listener's address.
+func startTestTLSServer(t *testing.T) string {
+	t.Helper()
+	hub := NewMemoryHub(1024*1024, time.Hour)
+	server, err := NewTLSServer(
+		"127.0.0.1:0", newTestTLSConfig(t), nil, "http://localhost:8080",
+		hub, NewInMemoryRateLimiter(), NewInMemoryBandwidthLimiter(1024*1024, 1024*1024, 0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(context.Background())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		server.Shutdown(ctx)
+		hub.Close()
+	})
+	return server.listener.Addr().String()
+}
+
+func TestTLSServerSlowHandshake(t *testing.T) {
+	address := startTestTLSServer(t)
+
+	tests := []struct {
+		name  string
+		feed  string
+		delay time.Duration
+	}{
+		{name: "fast client", feed: "fast-client", delay: 0},
+		{name: "slow client", feed: "slow-client", delay: handshakeTimeout * 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := net.Dial("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer raw.Close()
+			// Stall before sending the ClientHello, longer than the handshake line timeout
+			time.Sleep(tt.delay)
+			conn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+			conn.SetDeadline(time.Now().Add(time.Second * 5))
+			if err := conn.Handshake(); err != nil {
+				t.Fatalf("TLS handshake: %v", err)
+			}
+			if _, err := conn.Write([]byte(handshakePrefix + "name=" + tt.feed + "\n")); err != nil {
+				t.Fatalf("writing handshake: %v", err)
+			}
+			greeting, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading greeting: %v", err)
+			}
+			if want := "/feed/" + tt.feed; !strings.Contains(greeting, want) {
+				t.Errorf("greeting %q does not contain %q", greeting, want)
+			}
+		})
+	}
+}
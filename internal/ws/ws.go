@@ -1,8 +1,94 @@
 package ws
 
+import (
+	"bytes"
+	"errors"
+)
+
 // Application-specific status codes used for custom event handling
 // in nacre.
 const (
-	CloseTooManyPeers = 4001
-	CloseNotFound     = 4002
+	CloseTooManyPeers      = 4001
+	CloseNotFound          = 4002
+	CloseTooManyFeeds      = 4003
+	CloseFeedNameTaken     = 4004
+	CloseInvalidOwnerToken = 4005
+	CloseUnauthorized      = 4006
+)
+
+// Websocket handshake query parameters.
+const (
+	// ResumeParam carries the ID of the last entry a peer has received,
+	// so that it can resume listening after it.
+	ResumeParam = "resume"
+	// TailParam starts a live view at the feed's last N lines rather than
+	// at its start. It is ignored when resuming.
+	TailParam = "tail"
+	// ReplayParam requests a timed replay of the feed rather than a live view.
+	ReplayParam = "replay"
+	// SpeedParam sets the replay's initial speed multiplier.
+	SpeedParam = "speed"
+	// MaxIdleParam caps the replayed pause between two entries, in seconds.
+	MaxIdleParam = "idle"
+	// ViewKeyParam carries the view key of a password-protected feed, for clients
+	// which cannot set the X-Nacre-View-Key header.
+	ViewKeyParam = "view_key"
+)
+
+// Publishing handshake query parameters, matching the options of the TCP handshake.
+const (
+	// NameParam requests a custom name for the new feed.
+	NameParam = "name"
+	// FeedParam reattaches the publisher to an existing feed.
+	FeedParam = "feed"
+	// TokenParam carries the owner token of the feed to reattach to.
+	TokenParam = "token"
+	// PasswordParam sets the password which viewers must enter to see the feed.
+	PasswordParam = "password"
 )
+
+// Types of the events sent to publishers as JSON text messages.
+const (
+	// PublishEventFeed is sent once the publisher's feed is opened.
+	PublishEventFeed = "feed"
+	// PublishEventNotice informs the publisher about throttling or quotas.
+	PublishEventNotice = "notice"
+)
+
+// PublishEvent is sent to publishers, which stream their output as binary
+// or text messages after receiving the PublishEventFeed event.
+type PublishEvent struct {
+	Type       string `json:"type"`
+	FeedID     string `json:"feed_id,omitempty"`
+	FeedURL    string `json:"feed_url,omitempty"`
+	OwnerToken string `json:"owner_token,omitempty"` // Only sent for new feeds
+	Message    string `json:"message,omitempty"`
+}
+
+// entrySeparator separates an entry's ID from its data in binary messages.
+const entrySeparator = '\n'
+
+// ErrMalformedEntry is returned when decoding a binary message without an entry ID.
+var ErrMalformedEntry = errors.New("ws: malformed entry message")
+
+// EncodeEntry frames a feed entry as a binary websocket message, where the
+// entry's ID precedes its data and is terminated by a newline.
+//
+// Messages with an empty ID carry notices from the server rather than feed data,
+// such as when earlier entries were truncated. They cannot be resumed after.
+func EncodeEntry(id string, data []byte) []byte {
+	msg := make([]byte, 0, len(id)+1+len(data))
+	msg = append(msg, id...)
+	msg = append(msg, entrySeparator)
+	return append(msg, data...)
+}
+
+// DecodeEntry splits a binary websocket message framed by EncodeEntry into
+// the entry's ID and data.
+func DecodeEntry(msg []byte) (string, []byte, error) {
+	idx := bytes.IndexByte(msg, entrySeparator)
+	if idx < 0 {
+		return "", nil, ErrMalformedEntry
+	}
+	return string(msg[:idx]), msg[idx+1:], nil
+}
@@ -1,5 +1,9 @@
 const CLOSE_TOO_MANY_PEERS = 4001;
 const CLOSE_NOT_FOUND = 4002;
+const CLOSE_UNAUTHORIZED = 4006;
+
+const RECONNECT_MIN_DELAY_MS = 1_000;
+const RECONNECT_MAX_DELAY_MS = 30_000;
 
 (function () {
     const terminal = new Terminal({
@@ -19,34 +23,157 @@ const CLOSE_NOT_FOUND = 4002;
     });
     const protocol = window.location.protocol.startsWith('https') ? "wss://" : "ws://"
     const url = protocol + window.location.host + '/websocket';
-    const socket = new WebSocket(url);
-    socket.binaryType = 'arraybuffer';
     const decoder = new TextDecoder('utf-8');
-    socket.onmessage = function (ev) {
-        terminal.write(decoder.decode(ev.data));
-    };
-    socket.onopen = function () {
-        status.classList.remove('disconncted', 'error');
-        status.classList.add('connected');
-        socket.send(feedId);
-    };
-    socket.onclose = function (ev) {
-        status.classList.remove('connected', 'error');
-        terminal.options.cursorBlink = false;
-        switch (ev.code) {
-            case CLOSE_TOO_MANY_PEERS:
-            case CLOSE_NOT_FOUND:
-                socket.onerror(ev);
-                break;
-            default:
-                status.classList.add('disconnected');
+
+    // Replay mode replays a feed at the pace its output was originally received
+    const params = new URLSearchParams(window.location.search);
+    const replay = params.has('replay');
+    const replayControls = document.getElementById('replay-controls');
+    const replayToggle = document.getElementById('replay-toggle');
+    const replaySpeed = document.getElementById('replay-speed');
+    const replayIdle = document.getElementById('replay-idle');
+    const replaySeek = document.getElementById('replay-seek');
+    const replayPosition = document.getElementById('replay-position');
+    let replayPaused = false;
+    let seeking = false;
+
+    // ID of the last entry written to the terminal, used to resume after reconnecting
+    let lastId = '';
+    let reconnectDelay = RECONNECT_MIN_DELAY_MS;
+
+    // Binary messages are framed as "${entryId}\n${data}"
+    function decodeEntry(buffer) {
+        const bytes = new Uint8Array(buffer);
+        const idx = bytes.indexOf(0x0A);
+        if (idx < 0) {
+            return null;
         }
-    };
-    socket.onerror = function (ev) {
-        status.classList.remove('connected', 'disconnected');
-        status.classList.add('error');
-        terminal.options.cursorBlink = false;
-        const state = status.getElementsByClassName('details')[0];
-        state.innerHTML = ev.reason;
-    };
-}());
\ No newline at end of file
+        return {
+            id: decoder.decode(bytes.subarray(0, idx)),
+            data: bytes.subarray(idx + 1),
+        };
+    }
+
+    function setStatus(state, details) {
+        status.classList.remove('connected', 'disconnected', 'reconnecting', 'error');
+        status.classList.add(state);
+        status.getElementsByClassName('details')[0].textContent = details || '';
+    }
+
+    function socketURL() {
+        const query = new URLSearchParams();
+        if (replay) {
+            query.set('replay', '1');
+            query.set('speed', replaySpeed.value);
+            if (replayIdle.value) {
+                query.set('idle', replayIdle.value);
+            }
+        } else if (lastId) {
+            query.set('resume', lastId);
+        }
+        const qs = query.toString();
+        return qs ? url + '?' + qs : url;
+    }
+
+    function formatSeconds(seconds) {
+        const s = Math.floor(seconds);
+        return Math.floor(s / 60) + ':' + String(s % 60).padStart(2, '0');
+    }
+
+    function handleReplayStatus(replayStatus) {
+        if (replayStatus.type === 'reset') {
+            terminal.reset();
+        }
+        replayPaused = replayStatus.paused || replayStatus.finished;
+        replayToggle.textContent = replayPaused ? 'PLAY' : 'PAUSE';
+        replaySeek.max = replayStatus.duration;
+        if (!seeking) {
+            replaySeek.value = replayStatus.position;
+        }
+        replayPosition.textContent = formatSeconds(replayStatus.position) + ' / ' + formatSeconds(replayStatus.duration);
+    }
+
+    function connect() {
+        const socket = new WebSocket(socketURL());
+        socket.binaryType = 'arraybuffer';
+        if (replay) {
+            replayToggle.onclick = function () {
+                socket.send(JSON.stringify({ action: replayPaused ? 'play' : 'pause' }));
+            };
+            replaySpeed.onchange = function () {
+                socket.send(JSON.stringify({ action: 'speed', speed: parseFloat(replaySpeed.value) }));
+            };
+            replaySeek.oninput = function () {
+                seeking = true;
+            };
+            replaySeek.onchange = function () {
+                seeking = false;
+                socket.send(JSON.stringify({ action: 'seek', position: parseFloat(replaySeek.value) }));
+            };
+        }
+        socket.onmessage = function (ev) {
+            if (typeof ev.data === 'string') {
+                handleReplayStatus(JSON.parse(ev.data));
+                return;
+            }
+            const entry = decodeEntry(ev.data);
+            if (entry === null) {
+                return;
+            }
+            terminal.write(entry.data);
+            if (entry.id) {
+                // Entries without an ID are server notices, which cannot be resumed after
+                lastId = entry.id;
+            }
+        };
+        socket.onopen = function () {
+            reconnectDelay = RECONNECT_MIN_DELAY_MS;
+            terminal.options.cursorBlink = true;
+            setStatus('connected');
+            socket.send(feedId);
+        };
+        socket.onclose = function (ev) {
+            terminal.options.cursorBlink = false;
+            switch (ev.code) {
+                case CLOSE_TOO_MANY_PEERS:
+                case CLOSE_NOT_FOUND:
+                    setStatus('error', ev.reason);
+                    break;
+                case CLOSE_UNAUTHORIZED:
+                    // The feed's password has changed, so ask for the new one
+                    window.location.reload();
+                    break;
+                case 1000: // Normal closure: the feed has ended
+                    setStatus('disconnected');
+                    break;
+                default:
+                    scheduleReconnect();
+            }
+        };
+    }
+
+    function scheduleReconnect() {
+        setStatus('reconnecting', 'retrying in ' + Math.round(reconnectDelay / 1000) + 's');
+        setTimeout(function () {
+            if (replay) {
+                // Replays always start over from the beginning
+                terminal.reset();
+            }
+            connect();
+        }, reconnectDelay);
+        reconnectDelay = Math.min(reconnectDelay * 2, RECONNECT_MAX_DELAY_MS);
+    }
+
+    if (replay) {
+        replayControls.hidden = false;
+        replaySpeed.value = params.get('speed') || '1';
+        replayIdle.value = params.get('idle') || '';
+        replayIdle.onchange = function () {
+            // The idle limit changes the replay's timeline, so start over
+            params.set('idle', replayIdle.value);
+            params.set('speed', replaySpeed.value);
+            window.location.search = params.toString();
+        };
+    }
+    connect();
+}());